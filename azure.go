@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Azure OpenAI has its own flavour of the Batch API: the resource endpoint as
+// base URL, paths under /openai, an api-version query parameter, the key in an
+// api-key header, and deployment names instead of model names (Global Batch
+// deployments, which can't serve synchronous calls). An upstream of type azure
+// maps the models of the requests to its deployments:
+//
+//   {"name": "azure", "type": "azure", "base_url": "https://my-resource.openai.azure.com",
+//    "deployments": {"gpt-4o-mini": "gpt-4o-mini-batch"}, "sync_deployments": {"gpt-4o-mini": "gpt-4o-mini"}}
+//
+// Models without a deployment are sent as the deployment name.
+
+const (
+	upstreamOpenAI = "openai"
+	upstreamAzure  = "azure"
+
+	defaultAzureAPIVersion = "2024-10-21"
+)
+
+// azureEndpoints are the endpoints of Azure's Global Batch, batched unless the upstream lists others
+var azureEndpoints = []string{"/v1/chat/completions", "/v1/embeddings"}
+
+// azureURL is the URL of a path under /openai, e.g. /files or /deployments/x/chat/completions
+func (u *upstream) azureURL(apiPath string) string {
+	return u.BaseURL + "/openai" + apiPath + "?api-version=" + url.QueryEscape(u.APIVersion)
+}
+
+// deployment is the Global Batch deployment for a model
+func (u *upstream) deployment(model string) string {
+	if deployment, ok := u.Deployments[model]; ok {
+		return deployment
+	}
+	return model
+}
+
+// syncDeployment is the deployment for synchronous calls to a model
+func (u *upstream) syncDeployment(model string) string {
+	if deployment, ok := u.SyncDeployments[model]; ok {
+		return deployment
+	}
+	return u.deployment(model)
+}
+
+// azureSyncURL is the URL of a synchronous call: under the deployment of the model for batch endpoints
+func (u *upstream) azureSyncURL(apiPath, model string) string {
+	apiPath = strings.TrimPrefix(apiPath, "/v1")
+	if model == "" || endpointFor("/v1"+apiPath) == nil {
+		return u.azureURL(apiPath)
+	}
+	return u.azureURL("/deployments/" + url.PathEscape(u.syncDeployment(model)) + apiPath)
+}
+
+// azureBatchLine points a request of the batch input file to the deployment of its model
+func (u *upstream) azureBatchLine(req ProxyRequest) ProxyRequest {
+	req.Endpoint = u.batchEndpoint(req.Endpoint)
+	body, ok := req.Body.(map[string]interface{})
+	if !ok {
+		return req
+	}
+	model, _ := body["model"].(string)
+	adapted := make(map[string]interface{}, len(body)) // the original stays as is, for fallbacks and retries
+	for k, v := range body {
+		adapted[k] = v
+	}
+	adapted["model"] = u.deployment(model)
+	req.Body = adapted
+	return req
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAzureBatchLifecycle(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "2024-10-21", r.URL.Query().Get("api-version"))
+		assert.Equal(t, "azure-key", r.Header.Get("api-key"))
+		assert.Empty(t, r.Header.Get("Authorization"))
+
+		switch r.Method + " " + r.URL.Path {
+		case "POST /openai/files":
+			file, _, err := r.FormFile("file")
+			assert.NoError(t, err)
+			data, _ := io.ReadAll(file)
+			var line ProxyRequest
+			assert.NoError(t, json.Unmarshal(data, &line))
+			assert.Equal(t, "/chat/completions", line.Endpoint)
+			assert.Equal(t, "gpt-4o-mini-batch", line.Body.(map[string]interface{})["model"])
+			w.Write([]byte(`{"id":"file-1"}`))
+		case "POST /openai/batches":
+			var payload map[string]interface{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+			assert.Equal(t, "/chat/completions", payload["endpoint"])
+			w.Write([]byte(`{"id":"batch_1","status":"validating"}`))
+		case "GET /openai/batches/batch_1":
+			w.Write([]byte(`{"id":"batch_1","status":"completed","output_file_id":"file-2"}`))
+		case "GET /openai/files/file-2/content":
+			w.Write([]byte(`{"custom_id":"req_1","response":{"status_code":200,"body":{"id":"chatcmpl-1"}}}`))
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{
+		"name": "azure",
+		"type": "azure",
+		"base_url": "`+server.URL+`",
+		"models": ["gpt-4o-mini"],
+		"deployments": {"gpt-4o-mini": "gpt-4o-mini-batch"},
+		"sync_deployments": {"gpt-4o-mini": "gpt-4o-mini-standard"}
+	}]`), 0600))
+	assert.NoError(t, loadUpstreams(path))
+	defer func() { upstreams = []*upstream{defaultUpstream} }()
+
+	up, err := routeUpstream(http.Header{}, "gpt-4o-mini")
+	assert.NoError(t, err)
+	assert.True(t, up.batches("/v1/chat/completions"))
+	assert.False(t, up.batches("/v1/moderations"))
+	assert.Equal(t, server.URL+"/openai/deployments/gpt-4o-mini-standard/chat/completions?api-version=2024-10-21", up.url("/v1/chat/completions", "gpt-4o-mini"))
+	assert.Equal(t, server.URL+"/openai/models?api-version=2024-10-21", up.url("/v1/models", ""))
+
+	key := batchKey{credentials: credentials{upstream: up.Name, auth: "Bearer azure-key"}, endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	req := ProxyRequest{CustomID: "req_1", Method: "POST", Endpoint: key.endpoint, Body: map[string]interface{}{"model": "gpt-4o-mini"}}
+	fileID, err := uploadFile(marshalBatch(key, []ProxyRequest{req}), key.credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "file-1", fileID)
+	assert.Equal(t, "gpt-4o-mini", req.Body.(map[string]interface{})["model"], "the request itself keeps its model")
+
+	batchID, err := createBatch(fileID, key.credentials, key.endpoint)
+	assert.NoError(t, err)
+	batch, err := getBatchResponse(batchID, key.credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "completed", batch.Status)
+	content, err := readFile(*batch.OutputFileID, key.credentials)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "chatcmpl-1")
+}
@@ -1,29 +1,52 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
+	"net/http"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func createBatch(fileID string, auth, endpoint string) (string, error) {
+var errDetached = errors.New("proxy shutting down, batch detached")
+
+// batchTokenKey is the metadata key of the token that identifies a batch created by the proxy
+const batchTokenKey = "llm_proxy_token"
+
+func createBatch(fileID string, creds credentials, endpoint string) (string, error) {
 	log.WithFields(log.Fields{
 		"fileID":   fileID,
 		"endpoint": endpoint,
 	}).Debug("Creating batch")
 
-	url := fmt.Sprintf("%s/batches", OpenAIBaseURL)
+	url := creds.apiURL("/batches")
+	token := newULID()
 	payload := map[string]interface{}{
 		"input_file_id":     fileID,
-		"endpoint":          endpoint,
+		"endpoint":          upstreamNamed(creds.upstream).batchEndpoint(endpoint),
 		"completion_window": "24h",
+		"metadata":          map[string]string{batchTokenKey: token},
+	}
+
+	// The batch may have been created if the call failed ambiguously: look for it by its token
+	lookup := func(ctx context.Context) ([]byte, error) {
+		batches, err := listObjects(ctx, creds, withQuery(url, "limit=100"))
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range batches {
+			var batch BatchResponse
+			if json.Unmarshal(data, &batch) == nil && batch.Metadata[batchTokenKey] == token {
+				return data, nil
+			}
+		}
+		return nil, nil
 	}
 
 	jsonPayload, _ := json.Marshal(payload)
-	bodyContent, _, err := httpPost(url, auth, jsonPayload)
+	bodyContent, _, err := httpOp(url, "POST", creds, jsonPayload, nil, lookup)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"fileID": fileID,
@@ -48,13 +71,19 @@ func createBatch(fileID string, auth, endpoint string) (string, error) {
 	return batchResp.ID, err
 }
 
-func pollBatchStatus(batchID string, auth string) (*BatchResponse, error) {
+// pollBatchStatus waits for the batch to reach a final state. If it's still
+// running past the deadline (zero means no deadline), the batch is cancelled
+// and polling continues until the cancellation completes.
+func pollBatchStatus(batchID string, creds credentials, deadline time.Time) (*BatchResponse, error) {
 	log.WithField("batchID", batchID).Debug("Starting to poll batch status")
 
+	cancelRequested := false
 	for {
-		time.Sleep(SleepDuration)
+		if err := sleepUnlessDetached(); err != nil {
+			return nil, err
+		}
 
-		batchResp, err := getBatchResponse(batchID, auth)
+		batchResp, err := getBatchResponse(batchID, creds)
 		if err != nil {
 			log.WithFields(log.Fields{
 				"batchID": batchID,
@@ -94,16 +123,39 @@ func pollBatchStatus(batchID string, auth string) (*BatchResponse, error) {
 				"batchID": batchID,
 				"status":  batchResp.Status,
 			}).Debug("Batch still in progress")
-			time.Sleep(SleepDuration)
+			if !cancelRequested && !deadline.IsZero() && time.Now().After(deadline) {
+				log.WithField("batchID", batchID).Warn("Batch exceeded its grace period, cancelling")
+				if err := cancelBatch(batchID, creds); err == nil {
+					cancelRequested = true
+				}
+			}
+			if err := sleepUnlessDetached(); err != nil {
+				return nil, err
+			}
 		}
 	}
 }
 
-func getBatchResponse(batchID, auth string) (*BatchResponse, error) {
+// sleepUnlessDetached waits before polling again, and gives up if the proxy is
+// shutting down in detach mode (the next process will resume polling)
+func sleepUnlessDetached() error {
+	if shutdownMode != shutdownDetach {
+		time.Sleep(SleepDuration)
+		return nil
+	}
+	select {
+	case <-shutdownChan:
+		return errDetached
+	case <-time.After(SleepDuration):
+		return nil
+	}
+}
+
+func getBatchResponse(batchID string, creds credentials) (*BatchResponse, error) {
 	log.WithField("batchID", batchID).Debug("Fetching batch response")
 
-	url := fmt.Sprintf("%s/batches/%s", OpenAIBaseURL, batchID)
-	data, _, err := httpGet(url, auth)
+	url := creds.apiURL("/batches/" + batchID)
+	data, _, err := httpGet(url, creds)
 	if err != nil {
 		log.WithField("batchID", batchID).Errorf("Error fetching batch response: %v", err)
 		return nil, err
@@ -124,11 +176,26 @@ func getBatchResponse(batchID, auth string) (*BatchResponse, error) {
 	return &batchResp, err
 }
 
-func cancelBatch(batchID, auth string) error {
+func cancelBatch(batchID string, creds credentials) error {
 	log.WithField("batchID", batchID).Info("Attempting to cancel batch")
 
-	url := fmt.Sprintf("%s/batches/%s/cancel", OpenAIBaseURL, batchID)
-	_, _, err := httpPost(url, auth, nil)
+	url := creds.apiURL("/batches/" + batchID + "/cancel")
+	// cancelled already if the call failed ambiguously but the batch is no longer running
+	lookup := func(ctx context.Context) ([]byte, error) {
+		data, _, _, err := httpAttempt(ctx, creds.apiURL("/batches/"+batchID), http.MethodGet, creds, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var batch BatchResponse
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return nil, err
+		}
+		if batch.Status == "in_progress" || batch.Status == "validating" || batch.Status == "finalizing" {
+			return nil, nil
+		}
+		return data, nil
+	}
+	_, _, err := httpOp(url, "POST", creds, nil, nil, lookup)
 	if err != nil {
 		log.WithField("batchID", batchID).Errorf("Error cancelling batch: %v", err)
 	} else {
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBatchAPI is an OpenAI-compatible Files/Batches API. Batches stay in_progress
+// until finish returns a final status for them, with the lines of their output file.
+type fakeBatchAPI struct {
+	*httptest.Server
+	mu        sync.Mutex
+	files     map[string][]byte        // key: file ID
+	batches   map[string]BatchResponse // key: batch ID
+	cancelled map[string]bool          // key: batch ID
+	deleted   map[string]bool          // key: file ID
+	uploads   int
+	polls     int
+	syncCalls int
+	creates   int                 // batch creations received
+	names     map[string]string   // key: file ID of an upload, value: its filename
+	faults    map[string][]string // key: "upload" or "create", value: how the next ones fail, see fail
+	finish    func(requests []ProxyRequest, cancelled bool) (status string, output []string)
+}
+
+// newFakeBatchAPI starts a fake batch API as the upstream of the returned key, polled every few milliseconds
+func newFakeBatchAPI(t *testing.T, finish func(requests []ProxyRequest, cancelled bool) (string, []string)) (*fakeBatchAPI, batchKey) {
+	api := &fakeBatchAPI{
+		files:     make(map[string][]byte),
+		batches:   make(map[string]BatchResponse),
+		cancelled: make(map[string]bool),
+		deleted:   make(map[string]bool),
+		names:     make(map[string]string),
+		faults:    make(map[string][]string),
+		finish:    finish,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/files", api.handleUpload)
+	mux.HandleFunc("GET /v1/files", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		var list struct {
+			Data []map[string]string `json:"data"`
+		}
+		for id, name := range api.names {
+			list.Data = append(list.Data, map[string]string{"id": id, "filename": name})
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("GET /v1/files/{id}/content", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		w.Write(api.files[r.PathValue("id")])
+	})
+	mux.HandleFunc("DELETE /v1/files/{id}", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.deleted[r.PathValue("id")] = true
+	})
+	mux.HandleFunc("POST /v1/batches", api.handleCreate)
+	mux.HandleFunc("GET /v1/batches", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		var list struct {
+			Data []BatchResponse `json:"data"`
+		}
+		for _, batch := range api.batches {
+			list.Data = append(list.Data, batch)
+		}
+		json.NewEncoder(w).Encode(list)
+	})
+	mux.HandleFunc("GET /v1/batches/{id}", api.handlePoll)
+	mux.HandleFunc("POST /v1/batches/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.cancelled[r.PathValue("id")] = true
+		json.NewEncoder(w).Encode(api.batches[r.PathValue("id")])
+	})
+	mux.HandleFunc("POST /v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		api.mu.Lock()
+		api.syncCalls++
+		api.mu.Unlock()
+		w.Write([]byte(`{"id":"chatcmpl-sync","object":"chat.completion"}`))
+	})
+	api.Server = httptest.NewServer(mux)
+
+	upstreams = []*upstream{{Name: "fake", Type: upstreamOpenAI, BaseURL: api.URL + "/v1", Auth: authBearer}, defaultUpstream}
+	SleepDuration = 5 * time.Millisecond
+	t.Cleanup(func() {
+		api.Close()
+		upstreams = []*upstream{defaultUpstream}
+		SleepDuration = 5 * time.Second
+	})
+
+	key := batchKey{credentials: credentials{upstream: "fake", auth: "Bearer x"}, endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	return api, key
+}
+
+// fail makes the next upload or batch creation fail as planned in faults: "refuse"
+// closes the connection without processing it, "lose" closes it after processing
+// it, and "error" answers 502 after processing it. Returns whether it was answered.
+func (api *fakeBatchAPI) fail(w http.ResponseWriter, op string, processed bool) bool {
+	if len(api.faults[op]) == 0 {
+		return false
+	}
+	fault := api.faults[op][0]
+	switch {
+	case fault == "refuse" && !processed, fault == "lose" && processed:
+		closeConnection(w)
+	case fault == "error" && processed:
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		return false
+	}
+	api.faults[op] = api.faults[op][1:]
+	return true
+}
+
+func (api *fakeBatchAPI) handleUpload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	data, _ := io.ReadAll(file)
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.fail(w, "upload", false) {
+		return
+	}
+	api.uploads++
+	id := fmt.Sprintf("file-%d", len(api.files)+1)
+	api.files[id] = data
+	api.names[id] = header.Filename
+	if api.fail(w, "upload", true) {
+		return
+	}
+	fmt.Fprintf(w, `{"id":%q}`, id)
+}
+
+func (api *fakeBatchAPI) handleCreate(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		InputFileID string            `json:"input_file_id"`
+		Metadata    map[string]string `json:"metadata"`
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.creates++
+	if api.fail(w, "create", false) {
+		return
+	}
+	batch := BatchResponse{ID: fmt.Sprintf("batch_%d", len(api.batches)+1), Status: "in_progress", InputFileID: payload.InputFileID, Metadata: payload.Metadata}
+	api.batches[batch.ID] = batch
+	if api.fail(w, "create", true) {
+		return
+	}
+	json.NewEncoder(w).Encode(batch)
+}
+
+func (api *fakeBatchAPI) handlePoll(w http.ResponseWriter, r *http.Request) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	api.polls++
+	batch := api.batches[r.PathValue("id")]
+	if batch.Status == "in_progress" && api.finish != nil {
+		var requests []ProxyRequest
+		for _, line := range strings.Split(strings.TrimSpace(string(api.files[batch.InputFileID])), "\n") {
+			var req ProxyRequest
+			json.Unmarshal([]byte(line), &req)
+			requests = append(requests, req)
+		}
+		if status, output := api.finish(requests, api.cancelled[batch.ID]); status != "" {
+			outputID := fmt.Sprintf("file-%d", len(api.files)+1)
+			api.files[outputID] = []byte(strings.Join(output, "\n"))
+			batch.Status, batch.OutputFileID = status, &outputID
+			api.batches[batch.ID] = batch
+		}
+	}
+	json.NewEncoder(w).Encode(batch)
+}
+
+// closeConnection closes the connection of a request without answering it
+func closeConnection(w http.ResponseWriter) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	conn.Close()
+}
+
+func (api *fakeBatchAPI) counts() (uploads, polls, syncCalls int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.uploads, api.polls, api.syncCalls
+}
+
+func (api *fakeBatchAPI) isDeleted(fileID string) bool {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	return api.deleted[fileID]
+}
+
+// outputLine is a line of a batch output file with a response
+func outputLine(customID string) string {
+	return fmt.Sprintf(`{"custom_id":%q,"response":{"status_code":200,"body":{"id":"chatcmpl-batch"}}}`, customID)
+}
+
+// errorLine is a line of a batch error file, for a request that got no response
+func errorLine(customID, code string) string {
+	return fmt.Sprintf(`{"custom_id":%q,"response":null,"error":{"code":%q,"message":"Not run"}}`, customID, code)
+}
+
+// startBatch uploads the requests and creates their batch, as processBatch does, with clients waiting for them
+func startBatch(t *testing.T, key batchKey, customIDs ...string) (string, map[string]chan proxyResponse) {
+	var batch []ProxyRequest
+	waiting := make(map[string]chan proxyResponse)
+	for _, customID := range customIDs {
+		req := ProxyRequest{CustomID: customID, Method: "POST", Endpoint: key.endpoint, Body: map[string]interface{}{"model": key.model}}
+		batch = append(batch, req)
+		pendingRequests.Store(customID, req)
+		batchJournal.requestQueued(key, "", req, false, "")
+		waiting[customID] = make(chan proxyResponse, 1)
+		responseChanMap.Store(customID, waiting[customID])
+	}
+	t.Cleanup(func() {
+		for _, customID := range customIDs {
+			pendingRequests.Delete(customID)
+			responseChanMap.Delete(customID)
+		}
+	})
+
+	fileID, err := uploadFile(marshalBatch(key, batch), key.credentials)
+	assert.NoError(t, err)
+	batchID, err := createBatch(fileID, key.credentials, key.endpoint)
+	assert.NoError(t, err)
+	batchJournal.batchCreated(batchID, fileID, key, customIDs)
+	return batchID, waiting
+}
+
+func TestDetachLeavesBatchRunning(t *testing.T) {
+	api, key := newFakeBatchAPI(t, nil)
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	var err error
+	batchJournal, _, err = openJournal(path)
+	assert.NoError(t, err)
+	shutdownMode, shutdownChan = shutdownDetach, make(chan struct{})
+	defer func() { batchJournal, shutdownMode, shutdownChan = nil, shutdownCancel, make(chan struct{}) }()
+
+	batchID, _ := startBatch(t, key, "req_detach")
+	done := make(chan struct{})
+	go func() {
+		processBatchResponse(batchID, key, []string{"req_detach"}, time.Now())
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { _, polls, _ := api.counts(); return polls > 0 }, time.Second, time.Millisecond)
+
+	close(shutdownChan)
+	detachOutstandingBatches()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the batch is still being polled")
+	}
+	_, polls, _ := api.counts()
+	time.Sleep(20 * SleepDuration)
+	_, pollsLater, _ := api.counts()
+	assert.Equal(t, polls, pollsLater, "no longer polled")
+
+	// the next process resumes it
+	_, state, err := openJournal(path)
+	assert.NoError(t, err)
+	assert.Contains(t, state.batches, batchID)
+	assert.Contains(t, state.requests, "req_detach")
+}
+
+func TestCreateWithoutResponse(t *testing.T) {
+	api, key := newFakeBatchAPI(t, nil)
+	upstreamBaseBackoff = time.Millisecond
+	defer func() { upstreamBaseBackoff = time.Second }()
+	plan := func(op string, faults ...string) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		api.faults[op] = faults
+	}
+	counts := func() (uploads, creates, batches int) {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+		return api.uploads, api.creates, len(api.batches)
+	}
+
+	// processed, but the response was lost or an error: found instead of created again
+	plan("create", "lose", "error")
+	batchID, err := createBatch("file-1", key.credentials, key.endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, "batch_1", batchID)
+	batchID, err = createBatch("file-1", key.credentials, key.endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, "batch_2", batchID)
+	_, creates, batches := counts()
+	assert.Equal(t, 2, creates)
+	assert.Equal(t, 2, batches)
+
+	// not processed: created again
+	plan("create", "refuse")
+	batchID, err = createBatch("file-2", key.credentials, key.endpoint)
+	assert.NoError(t, err)
+	assert.Equal(t, "batch_3", batchID)
+	_, creates, batches = counts()
+	assert.Equal(t, 4, creates)
+	assert.Equal(t, 3, batches)
+
+	// the same goes for uploads
+	plan("upload", "error", "refuse")
+	fileID, err := uploadFile([]byte(`{"custom_id":"req_1"}`), key.credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "file-1", fileID)
+	fileID, err = uploadFile([]byte(`{"custom_id":"req_2"}`), key.credentials)
+	assert.NoError(t, err)
+	assert.Equal(t, "file-2", fileID)
+	uploads, _, _ := counts()
+	assert.Equal(t, 2, uploads)
+}
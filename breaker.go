@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A circuit breaker per credentials and endpoint around the Files/Batches API. After
+// -breaker-threshold consecutive failures (network errors, 5xx, 429) it opens:
+// for -breaker-cooldown, requests skip batching and go to the synchronous API
+// (up to -breaker-sync-budget of them per opening, 0 for no limit), or are
+// answered with a 503 if -breaker-fallback is fail. Then it's half-open: the
+// next batch is a probe, and its success closes the breaker again.
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+
+	breakerFallbackSync = "sync"
+	breakerFallbackFail = "fail"
+)
+
+var (
+	breakerThreshold  = 5
+	breakerCooldown   = time.Minute
+	breakerFallback   = breakerFallbackSync
+	breakerSyncBudget = 0
+	breakers          sync.Map // key: batchKey, value: *breaker
+)
+
+type breaker struct {
+	mu         sync.Mutex
+	key        batchKey
+	state      string
+	failures   int // consecutive
+	openedAt   time.Time
+	probing    bool // a probe batch is in flight (half-open)
+	syncBudget int  // synchronous requests left in this opening
+}
+
+// breakerStatus is how a breaker is shown in /stats
+type breakerStatus struct {
+	Upstream   string     `json:"upstream"`
+	Key        string     `json:"key"` // hash of the Authorization header
+	Project    string     `json:"project,omitempty"`
+	Endpoint   string     `json:"endpoint"`
+	State      string     `json:"state"`
+	Failures   int        `json:"failures"`
+	OpenedAt   *time.Time `json:"opened_at,omitempty"`
+	SyncBudget *int       `json:"sync_budget_left,omitempty"`
+}
+
+func breakerFor(key batchKey) *breaker {
+	key.model = "" // the batch API fails for all the models alike
+	value, _ := breakers.LoadOrStore(key, &breaker{key: key, state: breakerClosed})
+	return value.(*breaker)
+}
+
+// updateState moves an open breaker to half-open once the cooldown is over. Must hold mu.
+func (b *breaker) updateState() {
+	if b.state == breakerOpen && time.Since(b.openedAt) >= breakerCooldown {
+		log.WithField("endpoint", b.key.endpoint).Info("Circuit breaker half-open, probing the batch API")
+		b.state = breakerHalfOpen
+		b.probing = false
+	}
+}
+
+// allowBatch tells whether a batch can be submitted: always when closed, only one probe at a time when half-open
+func (b *breaker) allowBatch() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateState()
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	}
+	return false
+}
+
+// isOpen tells whether new requests should skip batching
+func (b *breaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.updateState()
+	return b.state == breakerOpen || b.state == breakerHalfOpen && b.probing
+}
+
+// takeSyncBudget reserves a synchronous request while the breaker is open
+func (b *breaker) takeSyncBudget() bool {
+	if breakerFallback != breakerFallbackSync {
+		return false
+	}
+	if breakerSyncBudget == 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.syncBudget <= 0 {
+		return false
+	}
+	b.syncBudget--
+	return true
+}
+
+// record updates the breaker with the outcome of a call to the batch API
+func (b *breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state != breakerClosed {
+			log.WithField("endpoint", b.key.endpoint).Info("Circuit breaker closed, batch API recovered")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		b.probing = false
+		return
+	}
+	if !isOutage(err) {
+		b.probing = false // inconclusive, let the next batch probe
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.state == breakerClosed && b.failures >= breakerThreshold {
+		log.WithFields(log.Fields{
+			"endpoint": b.key.endpoint,
+			"failures": b.failures,
+		}).Warnf("Circuit breaker open, batch API failing: %v", err)
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.probing = false
+		b.syncBudget = breakerSyncBudget
+	}
+}
+
+// isOutage tells whether an error says the batch API is in trouble, as opposed to a bad request
+func isOutage(err error) bool {
+	var statusErr *httpStatusError
+	return !errors.As(err, &statusErr) || statusErr.Retriable
+}
+
+// unavailableResponse is the answer to requests that can't be batched nor sent synchronously
+func unavailableResponse() proxyResponse {
+	return errorResponse(http.StatusServiceUnavailable, errCodeBatchUnavailable, "The batch API is failing and the synchronous fallback is unavailable, try again later")
+}
+
+// fallbackBatch answers the requests of a batch the breaker didn't let through:
+// synchronously while there's budget, with a 503 otherwise
+func fallbackBatch(key batchKey, batch []ProxyRequest) {
+	b := breakerFor(key)
+	sendSync := make(map[string]bool)
+	for _, req := range batch {
+		if b.takeSyncBudget() {
+			sendSync[req.CustomID] = true
+		} else {
+			sendErrorResponse(req.CustomID, key, unavailableResponse())
+		}
+	}
+	if len(sendSync) > 0 {
+		log.WithField("requests", len(sendSync)).Info("Circuit breaker open, sending batch synchronously")
+		sendAllSynchronously(sendSync, key)
+	}
+}
+
+func breakerStatuses() []breakerStatus {
+	statuses := []breakerStatus{}
+	breakers.Range(func(_, value interface{}) bool {
+		b := value.(*breaker)
+		b.mu.Lock()
+		b.updateState()
+		status := breakerStatus{
+			Upstream: upstreamNamed(b.key.upstream).Name,
+			Key:      hashAuth(b.key.auth)[:12],
+			Project:  b.key.project,
+			Endpoint: b.key.endpoint,
+			State:    b.state,
+			Failures: b.failures,
+		}
+		if b.state != breakerClosed {
+			openedAt := b.openedAt
+			status.OpenedAt = &openedAt
+			if breakerSyncBudget > 0 {
+				budget := b.syncBudget
+				status.SyncBudget = &budget
+			}
+		}
+		b.mu.Unlock()
+		statuses = append(statuses, status)
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		return a.Upstream+a.Key+a.Project+a.Endpoint < b.Upstream+b.Key+b.Project+b.Endpoint
+	})
+	return statuses
+}
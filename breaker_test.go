@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	breakerThreshold = 2
+	breakerCooldown = time.Hour
+	breakerSyncBudget = 1
+	defer func() { breakerThreshold, breakerCooldown, breakerSyncBudget = 5, time.Minute, 0 }()
+
+	b := breakerFor(batchKey{credentials: credentials{auth: "Bearer breaker"}, endpoint: "/v1/chat/completions"})
+	outage := errors.New("connection refused")
+
+	b.record(&httpStatusError{Status: 400}) // a bad request doesn't count
+	b.record(outage)
+	assert.False(t, b.isOpen())
+	b.record(outage)
+	assert.True(t, b.isOpen())
+	assert.False(t, b.allowBatch())
+	assert.True(t, b.takeSyncBudget())
+	assert.False(t, b.takeSyncBudget(), "budget exhausted")
+
+	// cooldown over: one probe batch at a time
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-2 * time.Hour)
+	b.mu.Unlock()
+	assert.False(t, b.isOpen())
+	assert.True(t, b.allowBatch())
+	assert.False(t, b.allowBatch())
+	assert.True(t, b.isOpen(), "requests skip batching while the probe is in flight")
+
+	b.record(nil)
+	assert.False(t, b.isOpen())
+	assert.True(t, b.allowBatch())
+}
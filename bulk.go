@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// POST /proxy/bulk takes a JSONL body in the batch API input format, one request per line:
+//
+//	{"custom_id": "my-id-1", "method": "POST", "url": "/v1/chat/completions", "body": {...}}
+//
+// The requests are fed into the regular batcher, and the results are streamed
+// back as JSONL in the batch API output format, in completion order.
+
+type bulkResult struct {
+	customID string
+	callerID string
+	response proxyResponse
+}
+
+func handleBulk(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errCodeInvalidRequest, "Method not allowed")
+		return
+	}
+	defer r.Body.Close()
+
+	creds := credentialsOf(r.Header)
+	var reqs []ProxyRequest
+	var keys []batchKey // of each request
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBatchMb*1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var req ProxyRequest
+		if err := json.Unmarshal(line, &req); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: invalid JSON: %v", lineNum, err))
+			return
+		}
+		switch {
+		case req.CustomID == "":
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: missing custom_id", lineNum))
+			return
+		case seen[req.CustomID]:
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: duplicate custom_id %q", lineNum, req.CustomID))
+			return
+		case endpointFor(req.Endpoint) == nil:
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: url %q can't be batched", lineNum, req.Endpoint))
+			return
+		case req.Method != "" && req.Method != http.MethodPost:
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: method must be POST", lineNum))
+			return
+		}
+		key := batchKey{credentials: creds, endpoint: req.Endpoint, model: requestModel(req.Body)}
+		up, err := routeUpstream(r.Header, key.model)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s header: %v", upstreamHeader, err))
+			return
+		}
+		if !up.batches(req.Endpoint) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Line %d: url %q can't be batched by upstream %s", lineNum, req.Endpoint, up.Name))
+			return
+		}
+		key.upstream = up.Name
+		if bodyMap, ok := req.Body.(map[string]interface{}); ok {
+			endpointFor(req.Endpoint).prepareBody(bodyMap) // results are written as a whole anyway
+		}
+		seen[req.CustomID] = true
+		reqs = append(reqs, req)
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Failed to read request body: %v", err))
+		return
+	}
+	log.WithField("requests", len(reqs)).Info("Bulk request received")
+
+	// buffered, so that forwarding a result never blocks once the client is gone
+	results := make(chan bulkResult, len(reqs))
+	var waitingLock sync.Mutex
+	waiting := make(map[string]chan proxyResponse, len(reqs)) // key: customID. Guarded by waitingLock
+	for i, req := range reqs {
+		trackRequestStart()
+		callerID := req.CustomID
+		responseChan := make(chan proxyResponse, 1)
+		customID := registerResponseChan(responseChan)
+		waiting[customID] = responseChan
+
+		key := keys[i]
+		body, _ := json.Marshal(req.Body)
+		req.CustomID = customID
+		req.Method = http.MethodPost
+		batchJournal.requestQueued(key, requestHash(key.credentials, req.Endpoint, body), req, false, "")
+		enqueueRequest(key, req)
+
+		safeGo(func() {
+			select {
+			case response := <-responseChan:
+				waitingLock.Lock()
+				delete(waiting, customID) // no longer withdrawn on disconnect
+				waitingLock.Unlock()
+				results <- bulkResult{customID: customID, callerID: callerID, response: response}
+			case <-r.Context().Done():
+			}
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/jsonl")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	enc := json.NewEncoder(w)
+	for remaining := len(reqs); remaining > 0; remaining-- {
+		select {
+		case result := <-results:
+			responseChanMap.Delete(result.customID)
+			batchJournal.requestDelivered(result.customID)
+
+			var line BatchRequestResponse
+			line.ID = result.customID
+			line.CustomID = result.callerID
+			line.Response.StatusCode = result.response.StatusCode
+			line.Response.Body = result.response.Body
+			if err := enc.Encode(line); err != nil {
+				log.Printf("[Bulk] Error writing result: %v", err)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			trackRequestEnd(!result.response.isError(), time.Since(start))
+
+		case <-r.Context().Done():
+			log.Info("Bulk client disconnected, withdrawing the remaining requests")
+			waitingLock.Lock()
+			for customID, responseChan := range waiting {
+				withdrawRequest(customID, responseChan)
+				batchJournal.requestDelivered(customID)
+				trackRequestAbandoned()
+			}
+			remaining -= len(waiting)
+			waitingLock.Unlock()
+			// the results already forwarded, or being forwarded, are dropped
+			for ; remaining > 0; remaining-- {
+				result := <-results
+				responseChanMap.Delete(result.customID)
+				batchJournal.requestDelivered(result.customID)
+				trackRequestAbandoned()
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulk(t *testing.T) {
+	release := make(chan struct{})
+	api, _ := newFakeBatchAPI(t, func(requests []ProxyRequest, cancelled bool) (string, []string) {
+		if requests[0].Body.(map[string]interface{})["model"] == "gpt-4o" {
+			select {
+			case <-release:
+			default:
+				return "", nil // still running
+			}
+		}
+		var output []string
+		for _, req := range requests {
+			output = append(output, outputLine(req.CustomID))
+		}
+		return "completed", output
+	})
+	maxHoldBatchSend = 10 * time.Millisecond
+	defer func() { maxHoldBatchSend = 4 * time.Second }()
+
+	proxy := httptest.NewServer(http.HandlerFunc(handleBulk))
+	defer proxy.Close()
+	body := strings.Join([]string{
+		`{"custom_id": "a-1", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt-4o"}}`,
+		`{"custom_id": "b-1", "method": "POST", "url": "/v1/chat/completions", "body": {"model": "gpt-4o-mini"}}`,
+		`{"custom_id": "b-2", "url": "/v1/chat/completions", "body": {"model": "gpt-4o-mini"}}`,
+	}, "\n")
+	req, _ := http.NewRequest(http.MethodPost, proxy.URL, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer bulk")
+	resp, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// results are streamed as they complete: the gpt-4o batch is still running
+	lines := bufio.NewScanner(resp.Body)
+	read := func() BatchRequestResponse {
+		assert.True(t, lines.Scan())
+		var line BatchRequestResponse
+		assert.NoError(t, json.Unmarshal(lines.Bytes(), &line))
+		return line
+	}
+	first, second := read(), read()
+	assert.ElementsMatch(t, []string{"b-1", "b-2"}, []string{first.CustomID, second.CustomID})
+	assert.NotEqual(t, first.CustomID, first.ID, "the proxy's ID is in id, the caller's in custom_id")
+	assert.Equal(t, 200, first.Response.StatusCode)
+
+	close(release)
+	last := read()
+	assert.Equal(t, "a-1", last.CustomID)
+	assert.False(t, lines.Scan(), "done")
+
+	uploads, _, _ := api.counts()
+	assert.Equal(t, 2, uploads, "one batch per model")
+}
+
+// blockingWriter holds the first write of the results until released
+type blockingWriter struct {
+	*httptest.ResponseRecorder
+	release chan struct{}
+}
+
+func (w blockingWriter) Write(b []byte) (int, error) {
+	<-w.release
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestBulkDisconnectWithResultsForwarded(t *testing.T) {
+	var lock sync.Mutex
+	var customIDs []string
+	api, _ := newFakeBatchAPI(t, func(requests []ProxyRequest, cancelled bool) (string, []string) {
+		var output []string
+		lock.Lock()
+		defer lock.Unlock()
+		for _, req := range requests {
+			customIDs = append(customIDs, req.CustomID)
+			output = append(output, outputLine(req.CustomID))
+		}
+		return "completed", output
+	})
+	maxHoldBatchSend = 10 * time.Millisecond
+	defer func() { maxHoldBatchSend = 4 * time.Second }()
+
+	body := strings.Join([]string{
+		`{"custom_id": "1", "url": "/v1/chat/completions", "body": {"model": "gpt-4o-mini"}}`,
+		`{"custom_id": "2", "url": "/v1/chat/completions", "body": {"model": "gpt-4o-mini"}}`,
+		`{"custom_id": "3", "url": "/v1/chat/completions", "body": {"model": "gpt-4o-mini"}}`,
+	}, "\n")
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/proxy/bulk", strings.NewReader(body)).WithContext(ctx)
+	r.Header.Set("Authorization", "Bearer bulk")
+	w := blockingWriter{httptest.NewRecorder(), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		handleBulk(w, r)
+		close(done)
+	}()
+
+	// the first result is being written when the client goes away, the others are forwarded
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, customID := range customIDs {
+			if _, pending := pendingRequests.Load(customID); pending {
+				return false
+			}
+		}
+		return len(customIDs) == 3
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	close(w.release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the handler is stuck")
+	}
+
+	for _, customID := range customIDs {
+		_, withdrawn := withdrawnRequests.Load(customID)
+		assert.False(t, withdrawn, "a delivered request isn't withdrawn")
+		_, waiting := responseChanMap.Load(customID)
+		assert.False(t, waiting)
+	}
+	assert.Eventually(t, func() bool { return api.isDeleted("file-2") }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestBulkInvalidLines(t *testing.T) {
+	for _, body := range []string{
+		`{"method": "POST", "url": "/v1/chat/completions", "body": {}}`,
+		`{"custom_id": "1", "url": "/v1/images/generations", "body": {}}`,
+		`{"custom_id": "1", "url": "/v1/chat/completions", "body": {}}` + "\n" + `{"custom_id": "1", "url": "/v1/chat/completions", "body": {}}`,
+		`not json`,
+	} {
+		w := httptest.NewRecorder()
+		handleBulk(w, httptest.NewRequest(http.MethodPost, "/proxy/bulk", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Clients can set "X-Proxy-Callback-URL" to be answered right away with a job,
+// and get the response POSTed to that URL when the batch finishes.
+//
+// If -callback-secret is set, the payload is signed: X-Proxy-Signature is
+// "sha256=" + hex(HMAC-SHA256(secret, X-Proxy-Timestamp + "." + body)).
+//
+// Callbacks are not sent to loopback, link-local, private or other special-purpose
+// addresses (the proxy would be a way into the network it runs in), unless the host
+// is listed in -callback-allow-hosts. Addresses are checked when connecting, so
+// that a name resolving to a public address when validated can't point elsewhere
+// later.
+
+const (
+	callbackHeader    = "X-Proxy-Callback-URL"
+	maxFailedCallback = 1000 // failed deliveries kept for inspection
+)
+
+var (
+	callbackSecret      = ""
+	callbackMaxAttempts = 5
+	callbackBackoff     = 2 * time.Second  // doubled after every failed attempt
+	callbackTimeout     = 30 * time.Second // of each attempt
+
+	failedCallbacks     []failedCallback
+	failedCallbacksLock sync.Mutex
+
+	callbackAllowHosts = map[string]bool{} // hosts callbacks may be sent to whatever their address
+	// callbackClient only connects to public addresses
+	callbackClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: rejectNonPublicAddress}).DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+)
+
+type failedCallback struct {
+	JobID     string    `json:"job_id"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error"`
+	Time      time.Time `json:"time"`
+	authHash  string    // of the job, only its key can list it
+}
+
+func validateCallbackURL(callbackURL string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return errors.New("must be an absolute http(s) URL")
+	}
+	host := u.Hostname()
+	if callbackAllowHosts[host] {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return fmt.Errorf("%s resolves to a non-public address", host)
+		}
+	}
+	return nil
+}
+
+// parseHosts parses a comma-separated list of hosts
+func parseHosts(s string) map[string]bool {
+	hosts := make(map[string]bool)
+	for _, host := range strings.Split(s, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts[host] = true
+		}
+	}
+	return hosts
+}
+
+// nonPublicPrefixes are the blocks of the IANA special-purpose address registries
+// that aren't globally reachable, multicast, and those embedding an IPv4 address
+// (NAT64, 6to4, Teredo) that could be any of them
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+	netip.MustParsePrefix("10.0.0.0/8"),      // private
+	netip.MustParsePrefix("100.64.0.0/10"),   // shared address space (CGNAT)
+	netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+	netip.MustParsePrefix("169.254.0.0/16"),  // link-local
+	netip.MustParsePrefix("172.16.0.0/12"),   // private
+	netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+	netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+	netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+	netip.MustParsePrefix("192.168.0.0/16"),  // private
+	netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+	netip.MustParsePrefix("198.51.100.0/24"), // documentation
+	netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+	netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),     // reserved, and broadcast
+	netip.MustParsePrefix("::/96"),           // unspecified, loopback, IPv4-compatible
+	netip.MustParsePrefix("64:ff9b::/96"),    // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"),  // local-use NAT64
+	netip.MustParsePrefix("100::/64"),        // discard-only
+	netip.MustParsePrefix("2001::/23"),       // IETF protocol assignments, Teredo
+	netip.MustParsePrefix("2001:db8::/32"),   // documentation
+	netip.MustParsePrefix("2002::/16"),       // 6to4
+	netip.MustParsePrefix("3fff::/20"),       // documentation
+	netip.MustParsePrefix("5f00::/16"),       // segment routing SIDs
+	netip.MustParsePrefix("fc00::/7"),        // unique local
+	netip.MustParsePrefix("fe80::/10"),       // link-local
+	netip.MustParsePrefix("ff00::/8"),        // multicast
+}
+
+// isPublicIP tells whether the address is outside nonPublicPrefixes, IPv4-mapped
+// addresses being checked as the IPv4 address they map
+func isPublicIP(ip net.IP) bool {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// rejectNonPublicAddress stops callbackClient from connecting to a non-public address
+func rejectNonPublicAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return fmt.Errorf("callbacks to %s aren't allowed", host)
+	}
+	return nil
+}
+
+func signPayload(timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(callbackSecret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliverCallback POSTs the response to the job's callback URL, retrying with backoff
+func deliverCallback(j *job, response proxyResponse) {
+	payload, err := json.Marshal(response.Body)
+	if err != nil {
+		recordFailedCallback(j, 0, fmt.Errorf("failed to marshal response: %v", err))
+		return
+	}
+
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		err = postCallback(j, response.StatusCode, payload)
+		if err == nil {
+			log.WithField("requestID", j.id).Debug("Callback delivered")
+			trackCallback(true)
+			j.mu.Lock()
+			j.markFetched()
+			j.mu.Unlock()
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"requestID": j.id,
+			"attempt":   attempt,
+		}).Warnf("Callback delivery failed: %v", err)
+		if attempt >= callbackMaxAttempts {
+			recordFailedCallback(j, attempt, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-shutdownChan:
+			recordFailedCallback(j, attempt, err)
+			return
+		}
+	}
+}
+
+func postCallback(j *job, statusCode int, payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.callback, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "github.com/xdrudis/llm-proxy")
+	req.Header.Set("X-Proxy-Job-ID", j.id)
+	req.Header.Set("X-Proxy-Status-Code", strconv.Itoa(statusCode))
+	req.Header.Set("X-Proxy-Timestamp", timestamp)
+	if callbackSecret != "" {
+		req.Header.Set("X-Proxy-Signature", signPayload(timestamp, payload))
+	}
+
+	client := callbackClient
+	if callbackAllowHosts[req.URL.Hostname()] {
+		client = httpClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP status code %d received", resp.StatusCode)
+	}
+	return nil
+}
+
+// recordFailedCallback keeps track of undelivered callbacks. The result can still be fetched from the job.
+func recordFailedCallback(j *job, attempts int, err error) {
+	log.WithField("requestID", j.id).Errorf("Giving up on callback to %s: %v", j.callback, err)
+	trackCallback(false)
+
+	failedCallbacksLock.Lock()
+	defer failedCallbacksLock.Unlock()
+	failedCallbacks = append(failedCallbacks, failedCallback{
+		JobID:     j.id,
+		URL:       j.callback,
+		Attempts:  attempts,
+		LastError: err.Error(),
+		Time:      time.Now(),
+		authHash:  j.authHash,
+	})
+	if len(failedCallbacks) > maxFailedCallback {
+		failedCallbacks = failedCallbacks[len(failedCallbacks)-maxFailedCallback:]
+	}
+}
+
+func handleFailedCallbacks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// like jobs, failed callbacks are only listed to the key that submitted them
+	authHash := hashAuth(r.Header.Get("Authorization"))
+	failed := []failedCallback{}
+	failedCallbacksLock.Lock()
+	for _, f := range failedCallbacks {
+		if f.authHash == authHash {
+			failed = append(failed, f)
+		}
+	}
+	failedCallbacksLock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(failed)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCallbackURL(t *testing.T) {
+	assert.NoError(t, validateCallbackURL("https://93.184.215.14/hooks/llm"))
+	for _, invalid := range []string{
+		"ftp://93.184.215.14/hooks",
+		"/hooks",
+		"http://localhost:8080/hooks",
+		"http://127.0.0.1/hooks",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/hooks",
+		"http://[::1]/hooks",
+	} {
+		assert.Error(t, validateCallbackURL(invalid), invalid)
+	}
+
+	callbackAllowHosts = parseHosts("10.0.0.5, hooks.internal")
+	defer func() { callbackAllowHosts = map[string]bool{} }()
+	assert.NoError(t, validateCallbackURL("http://10.0.0.5/hooks"))
+	assert.NoError(t, validateCallbackURL("http://hooks.internal/hooks"))
+
+	// checked again when connecting, whatever the name resolved to when validated
+	j := &job{id: "req_cb", callback: "http://127.0.0.1:9/hooks"}
+	assert.ErrorContains(t, postCallback(j, 200, []byte(`{}`)), "aren't allowed")
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for _, public := range []string{"93.184.215.14", "8.8.8.8", "100.63.255.255", "100.128.0.1", "198.20.0.1", "2606:4700::1111"} {
+		assert.True(t, isPublicIP(net.ParseIP(public)), public)
+	}
+	// an address in each special-purpose block, and its edges
+	for _, special := range []string{
+		"0.0.0.0", "0.255.255.255",
+		"10.0.0.1",
+		"100.64.0.0", "100.127.255.255",
+		"127.0.0.1",
+		"169.254.169.254",
+		"172.16.0.1", "172.31.255.255",
+		"192.0.0.8",
+		"192.0.2.1",
+		"192.88.99.1",
+		"192.168.1.1",
+		"198.18.0.1", "198.19.255.255",
+		"198.51.100.1",
+		"203.0.113.1",
+		"224.0.0.1",
+		"240.0.0.1", "255.255.255.255",
+		"::", "::1", "::127.0.0.1",
+		"::ffff:127.0.0.1", "::ffff:10.0.0.1", "::ffff:100.64.0.1",
+		"64:ff9b::7f00:1", "64:ff9b::808:808",
+		"64:ff9b:1::1",
+		"100::1",
+		"2001::1", "2001:db8::1",
+		"2002:7f00:1::1",
+		"3fff::1",
+		"5f00::1",
+		"fc00::1", "fd12:3456::1",
+		"fe80::1",
+		"ff02::1",
+	} {
+		assert.False(t, isPublicIP(net.ParseIP(special)), special)
+	}
+}
+
+func TestCallbackTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock // never answers in time
+	}))
+	defer server.Close()
+	defer close(unblock)
+	callbackAllowHosts = map[string]bool{"127.0.0.1": true}
+	callbackTimeout = 20 * time.Millisecond
+	defer func() { callbackAllowHosts, callbackTimeout = map[string]bool{}, 30*time.Second }()
+
+	done := make(chan error)
+	go func() { done <- postCallback(&job{id: "req_cb", callback: server.URL}, 200, []byte(`{}`)) }()
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("callback still waiting for the receiver")
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	callbackSecret = "s3cret"
+	defer func() { callbackSecret = "" }()
+
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(`1700000000.{"id":"chatcmpl-1"}`))
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), signPayload("1700000000", []byte(`{"id":"chatcmpl-1"}`)))
+}
+
+func TestDeliverCallback(t *testing.T) {
+	var attempts []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, `{"id":"chatcmpl-1"}`, string(body))
+		assert.Equal(t, "req_cb", r.Header.Get("X-Proxy-Job-ID"))
+		assert.Equal(t, "200", r.Header.Get("X-Proxy-Status-Code"))
+		assert.Equal(t, signPayload(r.Header.Get("X-Proxy-Timestamp"), body), r.Header.Get("X-Proxy-Signature"))
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	callbackAllowHosts = map[string]bool{"127.0.0.1": true}
+	callbackSecret = "s3cret"
+	callbackBackoff = 10 * time.Millisecond
+	defer func() { callbackAllowHosts, callbackSecret, callbackBackoff = map[string]bool{}, "", 2*time.Second }()
+
+	j := &job{id: "req_cb", authHash: hashAuth("Bearer a"), callback: server.URL}
+	deliverCallback(j, proxyResponse{StatusCode: 200, Body: map[string]interface{}{"id": "chatcmpl-1"}})
+	assert.Len(t, attempts, 3)
+	assert.True(t, j.fetched, "delivered")
+	// backoff doubles after every failed attempt
+	assert.GreaterOrEqual(t, attempts[1].Sub(attempts[0]), 10*time.Millisecond)
+	assert.GreaterOrEqual(t, attempts[2].Sub(attempts[1]), 20*time.Millisecond)
+}
+
+func TestFailedCallbacks(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+	callbackAllowHosts = map[string]bool{"127.0.0.1": true}
+	callbackBackoff = time.Millisecond
+	callbackMaxAttempts = 2
+	defer func() { callbackAllowHosts, callbackBackoff, callbackMaxAttempts = map[string]bool{}, 2*time.Second, 5 }()
+
+	j := &job{id: "req_cb_failed", authHash: hashAuth("Bearer a"), callback: server.URL}
+	deliverCallback(j, proxyResponse{StatusCode: 200, Body: map[string]interface{}{}})
+	assert.False(t, j.fetched)
+
+	list := func(auth string) []failedCallback {
+		r := httptest.NewRequest(http.MethodGet, "/proxy/callbacks/failed", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handleFailedCallbacks(w, r)
+		var failed []failedCallback
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&failed))
+		return failed
+	}
+	failed := list("Bearer a")
+	assert.Len(t, failed, 1)
+	assert.Equal(t, "req_cb_failed", failed[0].JobID)
+	assert.Equal(t, 2, failed[0].Attempts)
+	assert.Contains(t, failed[0].LastError, "500")
+	assert.Empty(t, list("Bearer b"), "other keys don't see it")
+}
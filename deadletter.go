@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests that fail for good (synthesized errors such as a failed upload, or
+// transient errors that ran out of retries) are kept in a dead-letter queue with
+// their original body, so that operators can replay them once the cause is fixed:
+//
+//   GET    /proxy/dead-letters              list the entries
+//   GET    /proxy/dead-letters/{id}         inspect an entry, with its request body
+//   POST   /proxy/dead-letters/{id}/replay  enqueue the request again, as a job
+//   DELETE /proxy/dead-letters/{id}         purge an entry
+//   DELETE /proxy/dead-letters              purge all of them
+//
+// With -dead-letter-file the queue is saved to that file (it contains the
+// Authorization header of each request, like the journal). Beyond
+// -max-dead-letters entries or -max-dead-letter-mb, the oldest are dropped.
+// These endpoints require the -admin-token in the X-Proxy-Admin-Token header,
+// and are disabled without one.
+
+const (
+	deadLetterPath   = "/proxy/dead-letters"
+	adminTokenHeader = "X-Proxy-Admin-Token"
+)
+
+// The dead-letter file is a JSONL log of additions and removals, compacted on
+// startup and whenever it grows well past the size of the live entries
+const (
+	deadLetterAdd    = "add"
+	deadLetterRemove = "remove"
+	deadLetterPurge  = "purge"
+
+	deadLetterCompactBytes = 1024 * 1024 // slack before compacting
+)
+
+var (
+	deadLetters     = newDeadLetterQueue()
+	adminToken      = ""
+	maxDeadLetters  = 10000
+	maxDeadLetterMb = 100
+	requestBatchIDs sync.Map // key: customID, value: ID of the batch the request was last sent in
+)
+
+type deadLetter struct {
+	ID           string       `json:"id"`
+	CustomID     string       `json:"custom_id"`
+	BatchID      string       `json:"batch_id,omitempty"`
+	StatusCode   int          `json:"status_code"`
+	Code         string       `json:"code,omitempty"`
+	Reason       string       `json:"reason"`
+	Time         time.Time    `json:"time"`
+	Replays      int          `json:"replays"`
+	Request      ProxyRequest `json:"request"`
+	Upstream     string       `json:"upstream,omitempty"`
+	Auth         string       `json:"auth"`
+	Organization string       `json:"organization,omitempty"`
+	Project      string       `json:"project,omitempty"`
+	Async        bool         `json:"async,omitempty"` // a job, that gets the result of a replay
+	Callback     string       `json:"callback,omitempty"`
+}
+
+type deadLetterRecord struct {
+	Op    string      `json:"op"`
+	Entry *deadLetter `json:"entry,omitempty"` // added
+	ID    string      `json:"id,omitempty"`    // removed
+}
+
+type deadLetterQueue struct {
+	mu       sync.Mutex
+	path     string   // empty: kept in memory only
+	file     *os.File // nil: kept in memory only
+	fileSize int
+	entries  map[string]*deadLetter
+	sizes    map[string]int // key: entry ID, value: size of its record
+	order    []string       // entry IDs, oldest first
+	bytes    int            // of the records of the entries
+}
+
+func newDeadLetterQueue() *deadLetterQueue {
+	return &deadLetterQueue{entries: make(map[string]*deadLetter), sizes: make(map[string]int)}
+}
+
+// openDeadLetters loads the dead-letter queue saved in path, and keeps saving it there
+func openDeadLetters(path string) error {
+	q := deadLetters
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = q.read(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	q.path = path
+	q.evict() // the caps may have been lowered
+	if err := q.compact(); err != nil {
+		return err
+	}
+	log.WithField("entries", len(q.entries)).Info("Loaded dead-letter queue")
+	return nil
+}
+
+// read applies the records of the file, of any size. Must hold mu.
+func (q *deadLetterQueue) read(f *os.File) error {
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec deadLetterRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				// most likely a torn write from a crash
+				log.Printf("[DeadLetter] Skipping unreadable record: %v", err)
+			} else {
+				q.apply(rec, len(line))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (q *deadLetterQueue) apply(rec deadLetterRecord, size int) {
+	switch rec.Op {
+	case deadLetterAdd:
+		if rec.Entry != nil {
+			q.insert(rec.Entry, size)
+		}
+	case deadLetterRemove:
+		q.remove(rec.ID)
+	case deadLetterPurge:
+		q.entries = make(map[string]*deadLetter)
+		q.sizes = make(map[string]int)
+		q.order = nil
+		q.bytes = 0
+	}
+}
+
+// insert adds an entry with the size of its record. Must hold mu.
+func (q *deadLetterQueue) insert(e *deadLetter, size int) {
+	q.remove(e.ID)
+	q.entries[e.ID] = e
+	q.sizes[e.ID] = size
+	q.order = append(q.order, e.ID)
+	q.bytes += size
+}
+
+// remove deletes an entry, if there. Must hold mu.
+func (q *deadLetterQueue) remove(id string) bool {
+	if _, ok := q.entries[id]; !ok {
+		return false
+	}
+	q.bytes -= q.sizes[id]
+	delete(q.entries, id)
+	delete(q.sizes, id)
+	q.order = slices.DeleteFunc(q.order, func(other string) bool { return other == id })
+	return true
+}
+
+// evict drops the oldest entries beyond -max-dead-letters and -max-dead-letter-mb. Must hold mu.
+func (q *deadLetterQueue) evict() {
+	for len(q.order) > 0 && (len(q.order) > maxDeadLetters || q.bytes > maxDeadLetterMb*1024*1024) {
+		e := q.entries[q.order[0]]
+		log.WithFields(log.Fields{
+			"requestID": e.CustomID,
+			"entry":     e.ID,
+		}).Warn("Dead-letter queue full, dropping its oldest entry")
+		q.remove(e.ID)
+		q.write(deadLetterRecord{Op: deadLetterRemove, ID: e.ID})
+	}
+}
+
+func marshalDeadLetterRecord(rec deadLetterRecord) ([]byte, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s record: %v", rec.Op, err)
+	}
+	return append(data, '\n'), nil
+}
+
+// write appends a record to the file. Must hold mu.
+func (q *deadLetterQueue) write(rec deadLetterRecord) {
+	if q.file == nil {
+		return
+	}
+	data, err := marshalDeadLetterRecord(rec)
+	if err != nil {
+		log.Errorf("[DeadLetter] %v", err)
+		return
+	}
+	q.writeData(data)
+}
+
+// writeData appends a marshaled record to the file, compacting it if mostly made
+// of removed entries. Must hold mu.
+func (q *deadLetterQueue) writeData(data []byte) {
+	if q.file == nil {
+		return
+	}
+	if _, err := q.file.Write(data); err != nil {
+		log.Errorf("[DeadLetter] Failed to save queue: %v", err)
+		return
+	}
+	q.fileSize += len(data)
+	if q.fileSize > 2*q.bytes+deadLetterCompactBytes {
+		if err := q.compact(); err != nil {
+			log.Errorf("[DeadLetter] Failed to compact queue: %v", err)
+		}
+	}
+}
+
+// compact rewrites the file with the entries only, replacing it atomically. Must hold mu.
+func (q *deadLetterQueue) compact() error {
+	if q.path == "" {
+		return nil
+	}
+	tmpPath := q.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter file: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	size := 0
+	for _, id := range q.order {
+		data, err := marshalDeadLetterRecord(deadLetterRecord{Op: deadLetterAdd, Entry: q.entries[id]})
+		if err == nil {
+			_, err = w.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write dead-letter file: %v", err)
+		}
+		size += len(data)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write dead-letter file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync dead-letter file: %v", err)
+	}
+	if err := os.Rename(tmpPath, q.path); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to replace dead-letter file: %v", err)
+	}
+
+	if q.file != nil {
+		q.file.Close()
+	}
+	q.file, q.fileSize = f, size
+	return nil
+}
+
+// sorted returns the entries, oldest first. Must hold mu.
+func (q *deadLetterQueue) sorted() []*deadLetter {
+	entries := make([]*deadLetter, 0, len(q.order))
+	for _, id := range q.order {
+		entries = append(entries, q.entries[id])
+	}
+	return entries
+}
+
+func (q *deadLetterQueue) size() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// add records an entry, dropping the oldest ones if the queue is full
+func (q *deadLetterQueue) add(e *deadLetter) {
+	data, err := marshalDeadLetterRecord(deadLetterRecord{Op: deadLetterAdd, Entry: e})
+	if err != nil {
+		log.Errorf("[DeadLetter] %v", err)
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.insert(e, len(data))
+	q.writeData(data)
+	q.evict()
+}
+
+// addDeadLetter records a request that failed for good. Must be called before
+// delivering the response, while the request is still pending.
+func addDeadLetter(customID string, key batchKey, response proxyResponse) {
+	value, ok := pendingRequests.Load(customID)
+	if !ok {
+		return // withdrawn, or already answered
+	}
+	e := &deadLetter{
+		ID:           "dl_" + newULID(),
+		CustomID:     customID,
+		StatusCode:   response.StatusCode,
+		Reason:       response.errorMessage(),
+		Time:         time.Now(),
+		Request:      value.(ProxyRequest),
+		Upstream:     key.upstream,
+		Auth:         key.auth,
+		Organization: key.organization,
+		Project:      key.project,
+	}
+	if batchID, ok := requestBatchIDs.Load(customID); ok {
+		e.BatchID = batchID.(string)
+	}
+	if body, ok := response.Body.(map[string]interface{}); ok {
+		if errBody, ok := body["error"].(map[string]interface{}); ok {
+			e.Code, _ = errBody["code"].(string)
+		}
+	}
+	e.Replays = int(attemptsOf(customID).replays.Load())
+	if value, ok := jobs.Load(customID); ok {
+		e.Async, e.Callback = true, value.(*job).callback
+	}
+
+	log.WithFields(log.Fields{
+		"requestID": customID,
+		"batchID":   e.BatchID,
+		"entry":     e.ID,
+	}).Warnf("Request failed for good, added to the dead-letter queue: %s", e.Reason)
+
+	deadLetters.add(e)
+}
+
+// take removes an entry from the queue
+func (q *deadLetterQueue) take(id string) (*deadLetter, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.entries[id]
+	if ok {
+		q.remove(id)
+		q.write(deadLetterRecord{Op: deadLetterRemove, ID: id})
+	}
+	return e, ok
+}
+
+// replay enqueues the request again, under its original ID. The job is completed
+// again (and its callback called), or created again if it expired. The client of
+// a synchronous or bulk request already got the error, so the result of its replay
+// goes to a new job, that it can fetch with the request ID it was answered with.
+func (e *deadLetter) replay() {
+	req := e.Request
+	key := batchKey{
+		credentials: credentials{upstream: upstreamNamed(e.Upstream).Name, auth: e.Auth, organization: e.Organization, project: e.Project},
+		endpoint:    req.Endpoint,
+		model:       requestModel(req.Body),
+	}
+	attemptsOf(req.CustomID).replays.Store(int32(e.Replays + 1))
+
+	responseChan := make(chan proxyResponse, 1)
+	responseChanMap.Store(req.CustomID, responseChan)
+	var j *job
+	if value, ok := jobs.Load(req.CustomID); ok {
+		j = value.(*job)
+		j.reopen()
+	} else {
+		j = newJob(req.CustomID, e.Auth, e.Callback, true)
+	}
+	safeGo(func() {
+		defer responseChanMap.Delete(req.CustomID)
+		response, _ := awaitResponse(context.Background(), req.CustomID, responseChan, time.Time{})
+		log.WithFields(log.Fields{
+			"requestID":  req.CustomID,
+			"statusCode": response.StatusCode,
+		}).Info("Replayed request finished")
+		j.complete(response)
+	})
+
+	log.WithFields(log.Fields{
+		"requestID": req.CustomID,
+		"entry":     e.ID,
+	}).Info("Replaying dead-lettered request")
+	batchJournal.requestQueued(key, "", req, true, e.Callback)
+	enqueueRequest(key, req)
+}
+
+// checkAdminToken answers 401 if the request lacks the admin token, and 403 if there's none
+func checkAdminToken(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		writeError(w, http.StatusForbidden, errCodeInvalidRequest, "Admin endpoints are disabled, set -admin-token to enable them")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(adminTokenHeader)), []byte(adminToken)) != 1 {
+		writeError(w, http.StatusUnauthorized, errCodeInvalidRequest, "Missing or wrong "+adminTokenHeader)
+		return false
+	}
+	return true
+}
+
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		deadLetters.mu.Lock()
+		entries := deadLetters.sorted()
+		list := make([]deadLetterSummary, 0, len(entries))
+		for _, e := range entries {
+			list = append(list, e.summary())
+		}
+		deadLetters.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodDelete:
+		deadLetters.mu.Lock()
+		purged := len(deadLetters.entries)
+		purge := deadLetterRecord{Op: deadLetterPurge}
+		deadLetters.apply(purge, 0)
+		deadLetters.write(purge)
+		deadLetters.mu.Unlock()
+
+		log.WithField("entries", purged).Info("Purged the dead-letter queue")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminToken(w, r) {
+		return
+	}
+	id := r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodGet:
+		deadLetters.mu.Lock()
+		e, ok := deadLetters.entries[id]
+		var entry deadLetterDetail
+		if ok {
+			entry = deadLetterDetail{deadLetterSummary: e.summary(), Request: e.Request}
+		}
+		deadLetters.mu.Unlock()
+		if !ok {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entry)
+	case http.MethodDelete:
+		if _, ok := deadLetters.take(id); !ok {
+			http.Error(w, "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(w, r) {
+		return
+	}
+
+	e, ok := deadLetters.take(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	e.replay()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobPath+e.CustomID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(e.summary())
+}
+
+// deadLetterSummary is an entry as listed, without the request body nor the Authorization header
+type deadLetterSummary struct {
+	ID         string    `json:"id"`
+	CustomID   string    `json:"custom_id"`
+	BatchID    string    `json:"batch_id,omitempty"`
+	Endpoint   string    `json:"endpoint"`
+	StatusCode int       `json:"status_code"`
+	Code       string    `json:"code,omitempty"`
+	Reason     string    `json:"reason"`
+	Time       time.Time `json:"time"`
+	Replays    int       `json:"replays"`
+}
+
+type deadLetterDetail struct {
+	deadLetterSummary
+	Request ProxyRequest `json:"request"`
+}
+
+func (e *deadLetter) summary() deadLetterSummary {
+	return deadLetterSummary{
+		ID:         e.ID,
+		CustomID:   e.CustomID,
+		BatchID:    e.BatchID,
+		Endpoint:   e.Request.Endpoint,
+		StatusCode: e.StatusCode,
+		Code:       e.Code,
+		Reason:     e.Reason,
+		Time:       e.Time,
+		Replays:    e.Replays,
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.json")
+	assert.NoError(t, openDeadLetters(path))
+	defer func() { deadLetters = newDeadLetterQueue() }()
+
+	req := ProxyRequest{CustomID: "req_dl", Method: "POST", Endpoint: "/v1/chat/completions", Body: map[string]interface{}{"model": "gpt-4o-mini"}}
+	pendingRequests.Store(req.CustomID, req)
+	defer pendingRequests.Delete(req.CustomID)
+	requestBatchIDs.Store(req.CustomID, "batch_1")
+	defer requestBatchIDs.Delete(req.CustomID)
+
+	key := batchKey{credentials: credentials{auth: "Bearer x", project: "proj_1"}, endpoint: req.Endpoint, model: "gpt-4o-mini"}
+	addDeadLetter(req.CustomID, key, errorResponse(502, errCodeUploadFailed, "Failed to upload file"))
+	addDeadLetter("req_unknown", key, errorResponse(502, errCodeUploadFailed, "Failed to upload file"))
+	assert.Equal(t, 1, deadLetters.size())
+
+	// reloaded from the file
+	deadLetters = newDeadLetterQueue()
+	assert.NoError(t, openDeadLetters(path))
+	entries := deadLetters.sorted()
+	assert.Len(t, entries, 1)
+	e := entries[0]
+	assert.Equal(t, "req_dl", e.CustomID)
+	assert.Equal(t, "batch_1", e.BatchID)
+	assert.Equal(t, errCodeUploadFailed, e.Code)
+	assert.Equal(t, "Bearer x", e.Auth)
+	assert.Equal(t, "proj_1", e.Project)
+	assert.Equal(t, "gpt-4o-mini", e.Request.Body.(map[string]interface{})["model"])
+
+	_, ok := deadLetters.take(e.ID)
+	assert.True(t, ok)
+	assert.Equal(t, 0, deadLetters.size())
+	deadLetters = newDeadLetterQueue()
+	assert.NoError(t, openDeadLetters(path))
+	assert.Equal(t, 0, deadLetters.size(), "the removal was saved")
+}
+
+func TestDeadLetterCaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	assert.NoError(t, openDeadLetters(path))
+	defer func() {
+		deadLetters = newDeadLetterQueue()
+		maxDeadLetters, maxDeadLetterMb = 10000, 100
+	}()
+
+	maxDeadLetters = 3
+	for i := 0; i < 5; i++ {
+		deadLetters.add(&deadLetter{ID: fmt.Sprintf("dl_%d", i), CustomID: fmt.Sprintf("req_%d", i)})
+	}
+	var ids []string
+	for _, e := range deadLetters.sorted() {
+		ids = append(ids, e.ID)
+	}
+	assert.Equal(t, []string{"dl_2", "dl_3", "dl_4"}, ids, "the oldest were dropped")
+
+	// the dropped entries stay dropped after a restart, and a lower cap applies
+	maxDeadLetters = 2
+	deadLetters = newDeadLetterQueue()
+	assert.NoError(t, openDeadLetters(path))
+	assert.Equal(t, 2, deadLetters.size())
+	assert.Equal(t, "dl_3", deadLetters.sorted()[0].ID)
+
+	// the file is compacted when it's mostly removed entries
+	maxDeadLetters = 10000
+	big := strings.Repeat("x", 100*1024)
+	for i := 0; i < 30; i++ {
+		deadLetters.add(&deadLetter{ID: fmt.Sprintf("dl_big_%d", i), Reason: big})
+		deadLetters.take(fmt.Sprintf("dl_big_%d", i))
+	}
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), int64(2*deadLetterCompactBytes))
+	assert.Equal(t, 2, deadLetters.size())
+}
+
+func TestAdminToken(t *testing.T) {
+	defer func() { adminToken = "" }()
+	list := func(token string) int {
+		r := httptest.NewRequest(http.MethodGet, deadLetterPath, nil)
+		if token != "" {
+			r.Header.Set(adminTokenHeader, token)
+		}
+		w := httptest.NewRecorder()
+		handleDeadLetters(w, r)
+		return w.Code
+	}
+
+	// without an admin token, the admin endpoints are disabled
+	assert.Equal(t, http.StatusForbidden, list(""))
+	assert.Equal(t, http.StatusForbidden, list("anything"))
+
+	adminToken = "s3cret"
+	assert.Equal(t, http.StatusUnauthorized, list(""))
+	assert.Equal(t, http.StatusUnauthorized, list("s3cre"))
+	assert.Equal(t, http.StatusOK, list("s3cret"))
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	api, key := newFakeBatchAPI(t, func(requests []ProxyRequest, cancelled bool) (string, []string) {
+		return "completed", []string{outputLine(requests[0].CustomID)}
+	})
+	adminToken = "s3cret"
+	maxHoldBatchSend = 10 * time.Millisecond
+	defer func() {
+		adminToken = ""
+		deadLetters = newDeadLetterQueue()
+		maxHoldBatchSend = 4 * time.Second
+	}()
+	replay := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, deadLetterPath+"/"+id+"/replay", nil)
+		r.SetPathValue("id", id)
+		r.Header.Set(adminTokenHeader, adminToken)
+		w := httptest.NewRecorder()
+		handleReplayDeadLetter(w, r)
+		return w
+	}
+	deadLetterFor := func(req ProxyRequest) string {
+		pendingRequests.Store(req.CustomID, req)
+		defer pendingRequests.Delete(req.CustomID)
+		addDeadLetter(req.CustomID, key, errorResponse(502, errCodeUploadFailed, "Failed to upload file"))
+		entries := deadLetters.sorted()
+		return entries[len(entries)-1].ID
+	}
+	completed := func(customID string) bool {
+		value, ok := jobs.Load(customID)
+		if !ok {
+			return false
+		}
+		j := value.(*job)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return j.status == jobCompleted && responseID(j.response) == "chatcmpl-batch" && j.authHash == hashAuth(key.auth)
+	}
+
+	// a job is completed with the result of the replay, even if it expired meanwhile
+	newJob("req_dl_job", key.auth, "", false)
+	jobID := deadLetterFor(ProxyRequest{CustomID: "req_dl_job", Method: "POST", Endpoint: key.endpoint, Body: map[string]interface{}{"model": "gpt-4o-mini"}})
+	jobs.Delete("req_dl_job")
+	w := replay(jobID)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, jobPath+"req_dl_job", w.Header().Get("Location"))
+	assert.Equal(t, 0, deadLetters.size())
+	assert.Eventually(t, func() bool { return completed("req_dl_job") }, 5*time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return api.isDeleted("file-2") }, 5*time.Second, 5*time.Millisecond)
+	jobs.Delete("req_dl_job")
+
+	// the client of a synchronous request got the error: the result goes to a new job
+	syncID := deadLetterFor(ProxyRequest{CustomID: "req_dl_sync", Method: "POST", Endpoint: key.endpoint, Body: map[string]interface{}{"model": "gpt-4o-mini"}})
+	assert.Equal(t, http.StatusAccepted, replay(syncID).Code)
+	assert.Equal(t, http.StatusNotFound, replay(syncID).Code, "taken")
+	assert.Eventually(t, func() bool { return completed("req_dl_sync") }, 5*time.Second, 5*time.Millisecond)
+	assert.Eventually(t, func() bool { return api.isDeleted("file-4") }, 5*time.Second, 5*time.Millisecond)
+	jobs.Delete("req_dl_sync")
+}
+
+func TestDeadLetterLargeEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	assert.NoError(t, openDeadLetters(path))
+	defer func() { deadLetters = newDeadLetterQueue() }()
+
+	big := strings.Repeat("x", 2*1024*1024)
+	deadLetters.add(&deadLetter{ID: "dl_big", CustomID: "req_big", Request: ProxyRequest{Body: map[string]interface{}{"input": big}}})
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	f.WriteString(`{"op":"add","entry":{"id":"dl_to`) // torn write
+	f.Close()
+
+	maxBatchMb = 1
+	defer func() { maxBatchMb = 25 }()
+	deadLetters = newDeadLetterQueue()
+	assert.NoError(t, openDeadLetters(path))
+	assert.Equal(t, 1, deadLetters.size())
+	assert.Equal(t, big, deadLetters.sorted()[0].Request.Body.(map[string]interface{})["input"])
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Clients that can't wait for a batch indefinitely send e.g. "X-Proxy-Max-Wait: 120s".
+// Requests that can't be answered within that time are sent through the synchronous API.
+const maxWaitHeader = "X-Proxy-Max-Wait"
+
+// parseMaxWait accepts a Go duration ("90s", "2m") or a number of seconds. Returns 0 if not set.
+func parseMaxWait(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		value = fmt.Sprintf("%ds", seconds)
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return d, nil
+}
+
+// expectedBatchTurnaround estimates how long a request being enqueued now will
+// wait for its response: the time to fill a batch of its partition plus the median duration of completed batches
+func expectedBatchTurnaround(key batchKey) time.Duration {
+	return limitsFor(key).maxHold + medianBatchTime()
+}
+
+// serveSynchronously relays the request to the synchronous API, as for endpoints we don't batch
+func serveSynchronously(w http.ResponseWriter, r *http.Request, body []byte, up *upstream, model string) {
+	trackSyncFallback()
+	forwardRequest(w, r, bytes.NewReader(body), up, model)
+}
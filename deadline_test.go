@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedBatchTurnaround(t *testing.T) {
+	batchTimingsLock.Lock()
+	completedBatchTimings = nil
+	batchTimingsLock.Unlock()
+	key := batchKey{endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	assert.Equal(t, maxHoldBatchSend, expectedBatchTurnaround(key))
+
+	// batches that failed to upload or be created don't make batches look fast
+	trackBatchEnd(false, time.Second)
+	trackBatchEnd(false, time.Second)
+	trackBatchEnd(true, time.Hour)
+	trackBatchCompleted(time.Hour)
+	assert.Equal(t, maxHoldBatchSend+time.Hour, expectedBatchTurnaround(key))
+
+	d, err := parseMaxWait("120")
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, d)
+	_, err = parseMaxWait("-1s")
+	assert.Error(t, err)
+}
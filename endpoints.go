@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sort"
+)
+
+// The endpoints the proxy batches, and how. Any other path is relayed to OpenAI
+// as-is. Making another endpoint of the batch API available is a matter of
+// registering it here.
+
+// endpoint describes a path of the batch API
+type endpoint struct {
+	path string
+	// limits override the global batch limits for this endpoint (zero fields don't);
+	// -partition-limits for a model override these
+	limits batchLimits
+	// prepare adapts the request body for the batch API, removing what it doesn't
+	// take, and tells whether the client asked for a stream (and for usage in it).
+	// nil: the body is batched as-is.
+	prepare func(body map[string]interface{}) (stream, includeUsage bool)
+	// streamEvents emulates the stream of a response, for clients that asked for
+	// one. nil: the endpoint doesn't stream.
+	streamEvents func(response map[string]interface{}, includeUsage bool) []streamEvent
+}
+
+var endpoints = map[string]*endpoint{} // key: path
+
+func init() {
+	registerEndpoint(&endpoint{
+		path:         "/v1/chat/completions",
+		prepare:      stripStreamOptions,
+		streamEvents: chatCompletionEvents,
+	})
+	registerEndpoint(&endpoint{
+		path:         "/v1/completions",
+		prepare:      stripStreamOptions,
+		streamEvents: textCompletionEvents,
+	})
+	registerEndpoint(&endpoint{
+		path:         "/v1/responses",
+		prepare:      stripResponseStream,
+		streamEvents: responseEvents,
+	})
+	registerEndpoint(&endpoint{path: "/v1/embeddings"})
+	registerEndpoint(&endpoint{path: "/v1/moderations"})
+}
+
+func registerEndpoint(e *endpoint) {
+	endpoints[e.path] = e
+}
+
+// endpointFor returns the batched endpoint at path, or nil if it isn't batched
+func endpointFor(path string) *endpoint {
+	return endpoints[path]
+}
+
+// batchPaths returns the paths of the batched endpoints, sorted
+func batchPaths() []string {
+	paths := make([]string, 0, len(endpoints))
+	for path := range endpoints {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// prepareBody adapts a request body for the batch API
+func (e *endpoint) prepareBody(body map[string]interface{}) (stream, includeUsage bool) {
+	if e.prepare == nil {
+		return false, false
+	}
+	stream, includeUsage = e.prepare(body)
+	return stream && e.streamEvents != nil, includeUsage
+}
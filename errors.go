@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// proxyResponse is what a waiting client gets for its request: the status
+// code and body of the batch line, of the synchronous API, or of an error
+// synthesized by the proxy
+type proxyResponse struct {
+	StatusCode int         `json:"status_code"`
+	Body       interface{} `json:"body"`
+}
+
+// error codes of the errors synthesized by the proxy
+const (
+	errCodeUploadFailed        = "batch_upload_failed"
+	errCodeCreateFailed        = "batch_create_failed"
+	errCodeStatusFailed        = "batch_status_failed"
+	errCodeBatchFailed         = "batch_failed"
+	errCodeBatchExpired        = "batch_expired"
+	errCodeBatchCancelled      = "batch_cancelled"
+	errCodeMissingResponse     = "missing_batch_response"
+	errCodeSyncFailed          = "sync_request_failed"
+	errCodeInvalidRequest      = "invalid_request"
+	errCodeIdempotencyMismatch = "idempotency_key_mismatch"
+	errCodeTokenLimitExceeded  = "token_limit_exceeded"
+	errCodeBatchUnavailable    = "batch_api_unavailable"
+	errCodeShuttingDown        = "proxy_shutting_down"
+)
+
+func (r proxyResponse) isError() bool {
+	return r.StatusCode >= 400
+}
+
+// errorResponse builds the standard OpenAI error envelope:
+// {"error": {"message": ..., "type": ..., "code": ..., "param": ...}}
+func errorResponse(status int, code, message string) proxyResponse {
+	errType := "invalid_request_error"
+	if status >= 500 {
+		errType = "server_error"
+	}
+	return proxyResponse{
+		StatusCode: status,
+		Body: map[string]interface{}{
+			"error": map[string]interface{}{
+				"message": message,
+				"type":    errType,
+				"code":    code,
+				"param":   nil,
+			},
+		},
+	}
+}
+
+// batchLineErrorResponse maps the error of a batch output line (a request that didn't get a response)
+func batchLineErrorResponse(e *OpenAiError) proxyResponse {
+	status := http.StatusInternalServerError
+	switch e.Code {
+	case errCodeBatchExpired:
+		status = http.StatusGatewayTimeout
+	case errCodeBatchCancelled:
+		status = http.StatusServiceUnavailable
+	}
+	response := errorResponse(status, e.Code, e.Message)
+	if e.Param != "" {
+		response.Body.(map[string]interface{})["error"].(map[string]interface{})["param"] = e.Param
+	}
+	return response
+}
+
+// notRun tells whether the error of a batch line is for a request the batch never
+// ran, because it was cancelled or expired first. Those aren't answered with the
+// error: they go through the synchronous API or a new batch, per the batch status.
+func notRun(e *OpenAiError) bool {
+	return e != nil && (e.Code == errCodeBatchCancelled || e.Code == errCodeBatchExpired)
+}
+
+// validationErrorResponse maps a validation error of a failed batch, for the request on its line
+func validationErrorResponse(e *OpenAiError) proxyResponse {
+	response := errorResponse(http.StatusBadRequest, e.Code, e.Message)
+	if e.Param != "" {
+		response.Body.(map[string]interface{})["error"].(map[string]interface{})["param"] = e.Param
+	}
+	return response
+}
+
+// normalizeResponse makes sure an error body has the complete OpenAI error envelope
+func normalizeResponse(status int, body interface{}) proxyResponse {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m, ok := body.(map[string]interface{})
+	if !ok || status < 400 {
+		return proxyResponse{StatusCode: status, Body: body}
+	}
+
+	e, ok := m["error"].(map[string]interface{})
+	if !ok {
+		message, _ := json.Marshal(body)
+		return errorResponse(status, "", string(message))
+	}
+	defaults := errorResponse(status, "", "").Body.(map[string]interface{})["error"].(map[string]interface{})
+	for k, v := range defaults {
+		if _, ok := e[k]; !ok {
+			e[k] = v
+		}
+	}
+	return proxyResponse{StatusCode: status, Body: m}
+}
+
+// upstreamErrorResponse reports a failed call to the Files/Batches API. Client
+// errors (e.g. 401 for a wrong API key) are passed through with OpenAI's
+// message; anything else is a 502 Bad Gateway.
+func upstreamErrorResponse(err error, code, message string) proxyResponse {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.Status >= 400 && statusErr.Status < 500 {
+		var body struct {
+			Error *OpenAiError `json:"error"`
+		}
+		if json.Unmarshal(statusErr.Body, &body) == nil && body.Error != nil {
+			response := errorResponse(statusErr.Status, body.Error.Code, message+": "+body.Error.Message)
+			if body.Error.Code == "" {
+				response.Body.(map[string]interface{})["error"].(map[string]interface{})["code"] = code
+			}
+			return response
+		}
+		return errorResponse(statusErr.Status, code, message+": "+err.Error())
+	}
+	return errorResponse(http.StatusBadGateway, code, message+": "+err.Error())
+}
+
+// missingResponse is the error for a request with no line in the batch output or error files
+func missingResponse(customID string, batch *BatchResponse) proxyResponse {
+	switch batch.Status {
+	case "expired":
+		return errorResponse(http.StatusGatewayTimeout, errCodeBatchExpired, "The batch expired before request ["+customID+"] was processed")
+	case "cancelled":
+		return errorResponse(http.StatusServiceUnavailable, errCodeBatchCancelled, "The batch was cancelled before request ["+customID+"] was processed")
+	case "failed":
+		message := "The batch failed"
+		if batch.Error != nil {
+			message += ": " + batch.Error.Message
+		} else if batch.Errors != nil && len(batch.Errors.Data) > 0 {
+			message += ": " + batch.Errors.Data[0].Message
+		}
+		return errorResponse(http.StatusBadRequest, errCodeBatchFailed, message)
+	default:
+		return errorResponse(http.StatusInternalServerError, errCodeMissingResponse, "No response received for request ["+customID+"] in the batch")
+	}
+}
+
+func (r proxyResponse) errorMessage() string {
+	if m, ok := r.Body.(map[string]interface{}); ok {
+		if e, ok := m["error"].(map[string]interface{}); ok {
+			if message, ok := e["message"].(string); ok {
+				return message
+			}
+		}
+	}
+	return ""
+}
+
+// writeError answers a request with an OpenAI error envelope
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	response := errorResponse(status, code, message)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response.Body)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeResponse(t *testing.T) {
+	response := normalizeResponse(0, map[string]interface{}{"id": "chatcmpl-1"})
+	assert.Equal(t, 200, response.StatusCode)
+
+	response = normalizeResponse(429, map[string]interface{}{
+		"error": map[string]interface{}{"message": "Rate limit reached", "type": "tokens"},
+	})
+	assert.Equal(t, 429, response.StatusCode)
+	assert.Equal(t, map[string]interface{}{
+		"message": "Rate limit reached",
+		"type":    "tokens",
+		"code":    "",
+		"param":   nil,
+	}, response.Body.(map[string]interface{})["error"])
+}
+
+func TestUpstreamErrorResponse(t *testing.T) {
+	unauthorized := &httpStatusError{Status: 401, Body: []byte(`{"error": {"message": "Incorrect API key provided", "code": "invalid_api_key"}}`)}
+	response := upstreamErrorResponse(fmt.Errorf("failed to send request: %w", unauthorized), errCodeUploadFailed, "Failed to upload file")
+	assert.Equal(t, 401, response.StatusCode)
+	assert.Equal(t, "Failed to upload file: Incorrect API key provided", response.errorMessage())
+	assert.Equal(t, "invalid_api_key", response.Body.(map[string]interface{})["error"].(map[string]interface{})["code"])
+
+	response = upstreamErrorResponse(errors.New("connection refused"), errCodeCreateFailed, "Failed to create batch")
+	assert.Equal(t, 502, response.StatusCode)
+	assert.Equal(t, errCodeCreateFailed, response.Body.(map[string]interface{})["error"].(map[string]interface{})["code"])
+}
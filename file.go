@@ -2,14 +2,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"mime/multipart"
 )
 
-func uploadFile(data []byte, auth string) (string, error) {
-	url := fmt.Sprintf("%s/files", OpenAIBaseURL)
+func uploadFile(data []byte, creds credentials) (string, error) {
+	url := creds.apiURL("/files")
+	filename := "batch_" + newULID() + ".jsonl" // identifies the file, if the upload fails ambiguously
 
 	var requestBody bytes.Buffer
 	multiPartWriter := multipart.NewWriter(&requestBody)
@@ -17,7 +19,7 @@ func uploadFile(data []byte, auth string) (string, error) {
 		return "", fmt.Errorf("failed to write purpose field: %v", err)
 	}
 
-	part, err := multiPartWriter.CreateFormFile("file", "data.jsonl")
+	part, err := multiPartWriter.CreateFormFile("file", filename)
 	if err != nil {
 		return "", fmt.Errorf("failed to create form file: %v", err)
 	}
@@ -33,9 +35,26 @@ func uploadFile(data []byte, auth string) (string, error) {
 		"Content-Type": multiPartWriter.FormDataContentType(),
 	}
 
-	responseData, _, err := httpOp(url, "POST", auth, &requestBody, headers)
+	// The file may have been uploaded if the call failed ambiguously: look for it by its name
+	lookup := func(ctx context.Context) ([]byte, error) {
+		files, err := listObjects(ctx, creds, withQuery(url, "purpose=batch&limit=100"))
+		if err != nil {
+			return nil, err
+		}
+		for _, data := range files {
+			var file struct {
+				Filename string `json:"filename"`
+			}
+			if json.Unmarshal(data, &file) == nil && file.Filename == filename {
+				return data, nil
+			}
+		}
+		return nil, nil
+	}
+
+	responseData, _, err := httpOp(url, "POST", creds, requestBody.Bytes(), headers, lookup)
 	if err != nil {
-		return "", fmt.Errorf("failed to send request: %v", err)
+		return "", fmt.Errorf("failed to send request: %w", err)
 	}
 
 	var fileResponse struct {
@@ -49,13 +68,13 @@ func uploadFile(data []byte, auth string) (string, error) {
 	return fileResponse.ID, err
 }
 
-func readFile(outputFileID, auth string) ([]byte, error) {
-	url := fmt.Sprintf("%s/files/%s/content", OpenAIBaseURL, outputFileID)
-	d, _, e := httpGet(url, auth)
+func readFile(outputFileID string, creds credentials) ([]byte, error) {
+	url := creds.apiURL("/files/" + outputFileID + "/content")
+	d, _, e := httpGet(url, creds)
 	return d, e
 }
 
-func deleteFile(fileID string, auth string) error {
-	url := fmt.Sprintf("%s/files/%s", OpenAIBaseURL, fileID)
-	return httpDelete(url, auth)
+func deleteFile(fileID string, creds credentials) error {
+	url := creds.apiURL("/files/" + fileID)
+	return httpDelete(url, creds)
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Intermediate proxies and NATs drop connections that stay idle for too long,
+// which is the normal state of a request waiting for its batch. With
+// -heartbeat-interval, the 200 status and headers are sent after the first
+// interval, and then whitespace is written periodically until the body is
+// ready. JSON parsers ignore leading whitespace; streams get SSE comments.
+
+var heartbeatInterval time.Duration // 0 disables heartbeats
+
+type heartbeat struct {
+	stopChan    chan struct{}
+	stopped     chan struct{}
+	headersSent bool
+}
+
+// startHeartbeat keeps the connection alive until stop is called. Returns nil if disabled.
+func startHeartbeat(w http.ResponseWriter, stream bool) *heartbeat {
+	flusher, ok := w.(http.Flusher)
+	if heartbeatInterval <= 0 || !ok {
+		return nil
+	}
+
+	hb := &heartbeat{
+		stopChan: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	keepAlive := []byte(" ")
+	if stream {
+		keepAlive = []byte(": keep-alive\n\n")
+	}
+
+	safeGo(func() {
+		defer close(hb.stopped)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if !hb.headersSent {
+					if stream {
+						writeStreamHeaders(w)
+					} else {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusOK)
+					}
+					hb.headersSent = true
+				}
+				if _, err := w.Write(keepAlive); err != nil {
+					log.Debugf("Heartbeat write failed, client likely gone: %v", err)
+					return
+				}
+				flusher.Flush()
+			case <-hb.stopChan:
+				return
+			}
+		}
+	})
+	return hb
+}
+
+// stop ends the heartbeat, returning whether the status and headers were already sent
+func (hb *heartbeat) stop() bool {
+	if hb == nil {
+		return false
+	}
+	close(hb.stopChan)
+	<-hb.stopped
+	return hb.headersSent
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeatBeforeLateError(t *testing.T) {
+	heartbeatInterval = 5 * time.Millisecond
+	defer func() { heartbeatInterval = 0 }()
+
+	w := httptest.NewRecorder()
+	hb := startHeartbeat(w, false)
+	time.Sleep(30 * time.Millisecond)
+	headersSent := hb.stop()
+	assert.True(t, headersSent)
+
+	// the status is gone: the error is written after the whitespace, still parseable JSON
+	writeResponse(w, nil, errorResponse(http.StatusBadGateway, errCodeUploadFailed, "Failed to upload file"), false, false, headersSent)
+	assert.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.True(t, strings.HasPrefix(body, " "))
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(body), &response))
+	assert.Equal(t, errCodeUploadFailed, response["error"].(map[string]interface{})["code"])
+}
+
+func TestHeartbeatStoppedEarly(t *testing.T) {
+	heartbeatInterval = time.Hour
+	defer func() { heartbeatInterval = 0 }()
+
+	w := httptest.NewRecorder()
+	assert.False(t, startHeartbeat(w, false).stop(), "nothing sent before the first interval")
+	assert.Empty(t, w.Body.String())
+
+	heartbeatInterval = 0
+	assert.Nil(t, startHeartbeat(w, false))
+}
@@ -3,89 +3,300 @@ package main
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"math"
+	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Calls to the Files/Batches API are retried on network errors and retriable
+// status codes, with exponential backoff and jitter. POSTs create files and
+// batches: when the outcome is ambiguous (a 408 or 5xx, or a network error once
+// the request was sent) they may have been processed, so they're only retried if
+// a lookup doesn't find what they created. Retry-After and OpenAI's
+// x-ratelimit-reset-* headers take precedence over the backoff. Each attempt has
+// a timeout, and the whole operation (with its retries) a deadline.
+
+var (
+	httpClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			ForceAttemptHTTP2:     true,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+			MaxIdleConnsPerHost:   16,
+		},
+	}
+
+	upstreamMaxAttempts    = 5
+	upstreamAttemptTimeout = 2 * time.Minute  // a 100 MB upload needs time
+	upstreamDeadline       = 10 * time.Minute // for an operation, with all its retries
+	upstreamBaseBackoff    = time.Second
+	upstreamMaxBackoff     = 30 * time.Second
+
+	// upstreamCtx is cancelled once shutdown is done with upstream calls (cancelling or detaching batches)
+	upstreamCtx, cancelUpstream = context.WithCancel(context.Background())
 )
 
-var httpClient = &http.Client{}
+// credentials say where an upstream call goes and whose account and project it's billed to
+type credentials struct {
+	upstream     string // name of the upstream
+	auth         string // Authorization header
+	organization string // OpenAI-Organization header
+	project      string // OpenAI-Project header
+}
+
+func credentialsOf(header http.Header) credentials {
+	return credentials{
+		auth:         header.Get("Authorization"),
+		organization: header.Get("OpenAI-Organization"),
+		project:      header.Get("OpenAI-Project"),
+	}
+}
+
+// apiURL is the URL of a path of the Files/Batches API (e.g. /files) at the upstream
+func (c credentials) apiURL(apiPath string) string {
+	return upstreamNamed(c.upstream).apiURL(apiPath)
+}
+
+// setHeaders adds the credentials to an upstream request
+func (c credentials) setHeaders(header http.Header) {
+	upstreamNamed(c.upstream).setAuth(header, c.auth)
+	if c.organization != "" {
+		header.Set("OpenAI-Organization", c.organization)
+	}
+	if c.project != "" {
+		header.Set("OpenAI-Project", c.project)
+	}
+}
+
+// httpStatusError is returned for non-2xx responses, so that callers can tell client from server errors
+type httpStatusError struct {
+	Status    int
+	Body      []byte
+	Retriable bool
+}
+
+func (e *httpStatusError) Error() string {
+	if e.Retriable {
+		return fmt.Sprintf("HTTP status code %d received: %s", e.Status, string(e.Body))
+	}
+	return fmt.Sprintf("HTTP non-retriable status code %d received: %s", e.Status, string(e.Body))
+}
+
+// lookupFunc looks for what a POST created, after an ambiguous failure. It returns
+// the response of the POST if it went through, nil if it didn't.
+type lookupFunc func(ctx context.Context) ([]byte, error)
 
-func httpGet(inputUrl, auth string) (data []byte, status int, err error) {
-	return httpOp(inputUrl, "GET", auth, nil, nil)
+func httpGet(inputUrl string, creds credentials) (data []byte, status int, err error) {
+	return httpOp(inputUrl, "GET", creds, nil, nil, nil)
 }
 
-func httpPost(inputUrl, auth string, body []byte) (data []byte, status int, err error) {
-	return httpOp(inputUrl, "POST", auth, bytes.NewReader(body), nil)
+// httpPost sends a POST that is only retried when it surely wasn't processed
+func httpPost(inputUrl string, creds credentials, body []byte) (data []byte, status int, err error) {
+	return httpOp(inputUrl, "POST", creds, body, nil, nil)
 }
 
-func httpDelete(inputUrl, auth string) error {
-	_, _, err := httpOp(inputUrl, "DELETE", auth, nil, nil)
+func httpDelete(inputUrl string, creds credentials) error {
+	_, _, err := httpOp(inputUrl, "DELETE", creds, nil, nil, nil)
 	return err
 }
 
-func httpOp(inputUrl, op, auth string, body io.Reader, additionalHeaders map[string]string) (data []byte, status int, err error) {
-	const maxRetries = 3
+// httpOp sends the request, retrying it with a fresh body until it succeeds, fails
+// with a non-retriable status, runs out of attempts or passes the operation deadline.
+// A POST with an ambiguous outcome is retried only if lookup says it didn't go through.
+func httpOp(inputUrl, op string, creds credentials, body []byte, additionalHeaders map[string]string, lookup lookupFunc) (data []byte, status int, err error) {
+	if _, err := http.NewRequest(op, inputUrl, nil); err != nil {
+		return nil, 0, err // not worth retrying
+	}
+	ctx, cancel := context.WithTimeout(upstreamCtx, upstreamDeadline)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		var retryAfter time.Duration
+		data, status, retryAfter, err = httpAttempt(ctx, inputUrl, op, creds, body, additionalHeaders)
+
+		var statusErr *httpStatusError
+		retriable := err != nil && (!errors.As(err, &statusErr) || statusErr.Retriable)
+		if !retriable {
+			return data, status, err
+		}
+		if op == http.MethodPost && ambiguous(err) {
+			// may have been processed: a retry could create a duplicate
+			if lookup == nil {
+				return data, status, err
+			}
+			found, lookupErr := lookup(ctx)
+			if lookupErr != nil {
+				log.WithField("url", inputUrl).Warnf("Can't tell whether the failed call went through: %v", lookupErr)
+				return data, status, err
+			}
+			if found != nil {
+				log.WithField("url", inputUrl).Warnf("Upstream call went through despite failing: %v", err)
+				return found, http.StatusOK, nil
+			}
+		}
+		if attempt >= upstreamMaxAttempts || ctx.Err() != nil {
+			return data, status, err
+		}
+
+		wait := retryAfter
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		if deadline, _ := ctx.Deadline(); time.Until(deadline) < wait {
+			return data, status, err // can't wait that long
+		}
+		log.WithFields(log.Fields{
+			"url":     inputUrl,
+			"attempt": attempt,
+			"wait":    wait,
+		}).Warnf("Upstream call failed, retrying: %v", err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return data, status, err
+		}
+	}
+}
+
+// httpAttempt sends the request once. retryAfter is the wait asked for by the server, if any.
+func httpAttempt(ctx context.Context, inputUrl, op string, creds credentials, body []byte, additionalHeaders map[string]string) (data []byte, status int, retryAfter time.Duration, err error) {
 	const userAgent = "github.com/xdrudis/llm-proxy"
 
-	req, err := http.NewRequest(op, inputUrl, body)
+	ctx, cancel := context.WithTimeout(ctx, upstreamAttemptTimeout)
+	defer cancel()
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, op, inputUrl, bodyReader)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Accept-Encoding", "gzip")
-	if auth != "" {
-		req.Header.Set("Authorization", auth)
-	}
-
+	creds.setHeaders(req.Header)
 	for key, value := range additionalHeaders {
 		req.Header.Set(key, value)
 	}
 
-	for i := 0; i < maxRetries; i++ {
-		if i > 0 {
-			time.Sleep(time.Duration(math.Pow(1.5, float64(i))) * time.Second)
-		}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, -1, 0, err
+	}
+	defer resp.Body.Close()
 
-		var resp *http.Response
-		if resp, err = httpClient.Do(req); err != nil {
-			continue
+	status = resp.StatusCode
+	reader := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, status, 0, err
 		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
 
-		status = resp.StatusCode
-		reader := resp.Body
-		if resp.Header.Get("Content-Encoding") == "gzip" {
-			var gzipReader *gzip.Reader
-			gzipReader, err = gzip.NewReader(resp.Body)
-			if err != nil {
-				resp.Body.Close()
-				return nil, status, err
-			}
-			defer gzipReader.Close()
-			reader = gzipReader
-		}
+	data, err = io.ReadAll(reader)
+	if err != nil {
+		return nil, status, 0, err
+	}
 
-		data, err = io.ReadAll(reader)
-		resp.Body.Close()
-		if err != nil {
-			continue
-		}
+	if isRetriable(status) {
+		return nil, status, retryAfterHeader(resp.Header), &httpStatusError{Status: status, Body: data, Retriable: true}
+	} else if status < 200 || status >= 300 {
+		return nil, status, 0, &httpStatusError{Status: status, Body: data}
+	}
+	return data, status, 0, nil
+}
 
-		if isRetriable(status) {
-			_ = resp.Body.Close()
-			if i == maxRetries-1 { // exhausted retries
-				return nil, status, fmt.Errorf("HTTP status code %d received: %s", status, string(data))
-			}
-			continue
-		} else if status < 200 || status >= 300 {
-			_ = resp.Body.Close()
-			return nil, status, fmt.Errorf("HTTP non-retriable status code %d received: %s", status, string(data))
+// ambiguous tells whether a failed request may have been processed: it got a 408
+// or 5xx, or a network error once sent. A 429 means it wasn't.
+func ambiguous(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Status == http.StatusRequestTimeout || statusErr.Status >= 500
+	}
+	return !notSent(err)
+}
+
+// notSent tells whether a network error happened before the request could reach the server
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
+
+// listObjects gets the objects of a list of the API (e.g. of files or batches), in a single attempt
+func listObjects(ctx context.Context, creds credentials, listURL string) ([]json.RawMessage, error) {
+	data, _, _, err := httpAttempt(ctx, listURL, http.MethodGet, creds, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+	return list.Data, nil
+}
+
+// withQuery appends a query string to a URL, which may have one already (e.g. Azure's api-version)
+func withQuery(rawURL, query string) string {
+	if strings.Contains(rawURL, "?") {
+		return rawURL + "&" + query
+	}
+	return rawURL + "?" + query
+}
+
+// backoff is the exponential backoff before the next attempt, with jitter
+func backoff(attempt int) time.Duration {
+	wait := upstreamBaseBackoff << (attempt - 1)
+	if wait > upstreamMaxBackoff || wait <= 0 {
+		wait = upstreamMaxBackoff
+	}
+	// equal jitter: half fixed, half random, so that clients don't retry in lockstep
+	return wait/2 + time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// retryAfterHeader reads how long the server asks us to wait: Retry-After (seconds
+// or HTTP date), or else the longest of OpenAI's x-ratelimit-reset-requests and
+// x-ratelimit-reset-tokens (e.g. "1s", "6m0s")
+func retryAfterHeader(header http.Header) time.Duration {
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if date, err := http.ParseTime(value); err == nil {
+			return max(time.Until(date), 0)
 		}
+	}
 
-		return data, status, err
+	var wait time.Duration
+	for _, name := range []string{"x-ratelimit-reset-requests", "x-ratelimit-reset-tokens"} {
+		if d, err := time.ParseDuration(header.Get(name)); err == nil && d > wait {
+			wait = d
+		}
 	}
-	return nil, -1, err
+	return wait
 }
 
 func isRetriable(httpStatusCode int) bool {
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpOpRetries(t *testing.T) {
+	upstreamBaseBackoff = time.Millisecond
+	defer func() { upstreamBaseBackoff = time.Second }()
+
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "proj_1", r.Header.Get("OpenAI-Project"))
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"id":"batch_1"}`))
+	}))
+	defer server.Close()
+
+	// a 503 may have been processed: retried only after looking for what it created
+	var lookups int
+	notCreated := func(ctx context.Context) ([]byte, error) {
+		lookups++
+		return nil, nil
+	}
+	data, status, err := httpOp(server.URL, http.MethodPost, credentials{auth: "Bearer x", project: "proj_1"}, []byte(`{"input_file_id":"file_1"}`), nil, notCreated)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, lookups)
+	assert.Equal(t, 200, status)
+	assert.Equal(t, `{"id":"batch_1"}`, string(data))
+	// every attempt sends the whole body
+	assert.Equal(t, []string{`{"input_file_id":"file_1"}`, `{"input_file_id":"file_1"}`, `{"input_file_id":"file_1"}`}, bodies)
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	header := http.Header{}
+	assert.Equal(t, time.Duration(0), retryAfterHeader(header))
+
+	header.Set("x-ratelimit-reset-requests", "1s")
+	header.Set("x-ratelimit-reset-tokens", "6m0s")
+	assert.Equal(t, 6*time.Minute, retryAfterHeader(header))
+
+	header.Set("Retry-After", "20")
+	assert.Equal(t, 20*time.Second, retryAfterHeader(header))
+}
+
+func TestHttpOpAmbiguousErrors(t *testing.T) {
+	upstreamBaseBackoff = time.Millisecond
+	defer func() { upstreamBaseBackoff = time.Second }()
+
+	// the connection is closed without a response: the request may have been processed
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		closeConnection(w)
+	}))
+	defer server.Close()
+
+	_, _, err := httpPost(server.URL, credentials{auth: "Bearer x"}, []byte(`{"input_file_id":"file_1"}`))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), hits.Load(), "a POST isn't retried without a lookup")
+
+	hits.Store(0)
+	_, _, err = httpGet(server.URL, credentials{auth: "Bearer x"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(upstreamMaxAttempts), hits.Load())
+
+	// a refused connection never reached the server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	_, _, err = httpPost(closed.URL, credentials{auth: "Bearer x"}, nil)
+	assert.True(t, notSent(err), "%v", err)
+}
+
+func TestSyncRequestDeadline(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hang:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hang)
+	upstreams = []*upstream{{Name: "fake", Type: upstreamOpenAI, BaseURL: server.URL + "/v1", Auth: authBearer}, defaultUpstream}
+	defer func() { upstreams = []*upstream{defaultUpstream} }()
+	creds := credentials{upstream: "fake", auth: "Bearer x"}
+
+	upstreamDeadline = 50 * time.Millisecond
+	_, err := sendSyncRequest(creds, "/v1/chat/completions", map[string]interface{}{"model": "gpt-4o-mini"})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	upstreamDeadline = 10 * time.Minute
+
+	// and shutdown cancels it
+	upstreamCtx, cancelUpstream = context.WithCancel(context.Background())
+	defer func() { upstreamCtx, cancelUpstream = context.WithCancel(context.Background()) }()
+	time.AfterFunc(50*time.Millisecond, cancelUpstream)
+	_, err = sendSyncRequest(creds, "/v1/chat/completions", map[string]interface{}{"model": "gpt-4o-mini"})
+	assert.ErrorIs(t, err, context.Canceled)
+}
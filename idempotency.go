@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A client that times out and retries would pay again for the same completion.
+// With an Idempotency-Key header, a retry with the same key and body attaches
+// to the original request, pending or completed, instead of creating a new one.
+// Keys are scoped to the Authorization header.
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var (
+	idempotencyRetention   = 24 * time.Hour
+	idempotencyKeys        sync.Map // key: hash of auth + Idempotency-Key, value: *idempotentRequest
+	errIdempotencyMismatch = errors.New("Idempotency-Key was already used with a different request")
+)
+
+type idempotentRequest struct {
+	mu        sync.Mutex
+	customID  string
+	hash      string // requestHash of the original request
+	done      bool
+	response  proxyResponse
+	completed time.Time
+	waiters   []chan proxyResponse
+}
+
+// claimIdempotencyKey registers customID as the request for the key, unless there's
+// already one. owner tells whether the caller is the original request.
+func claimIdempotencyKey(auth, key, hash, customID string) (entry *idempotentRequest, owner bool, err error) {
+	value, loaded := idempotencyKeys.LoadOrStore(hashAuth(auth)+":"+key, &idempotentRequest{
+		customID: customID,
+		hash:     hash,
+	})
+	entry = value.(*idempotentRequest)
+	if loaded && entry.hash != hash {
+		return nil, false, errIdempotencyMismatch
+	}
+	return entry, !loaded, nil
+}
+
+// complete stores the response of the original request and hands it to the retries waiting for it
+func (e *idempotentRequest) complete(response proxyResponse) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.done = true
+	e.response = response
+	e.completed = time.Now()
+	for _, waiter := range e.waiters {
+		waiter <- response
+	}
+	e.waiters = nil
+}
+
+// wait returns a channel with the response of the original request, once available
+func (e *idempotentRequest) wait() chan proxyResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	waiter := make(chan proxyResponse, 1)
+	if e.done {
+		waiter <- e.response
+	} else {
+		e.waiters = append(e.waiters, waiter)
+	}
+	return waiter
+}
+
+// stopWaiting forgets a waiter whose client went away
+func (e *idempotentRequest) stopWaiting(waiter chan proxyResponse) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for i, w := range e.waiters {
+		if w == waiter {
+			e.waiters = append(e.waiters[:i], e.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// serveIdempotentRetry answers a retry with the original request's response, or job
+func serveIdempotentRetry(w http.ResponseWriter, r *http.Request, e *idempotentRequest, auth string, ep *endpoint, async, stream, includeUsage bool) {
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set(proxyRequestIDHeader, e.customID)
+
+	if async {
+		if value, ok := jobs.Load(e.customID); ok {
+			writeJobAccepted(w, value.(*job))
+			return
+		}
+		// the original request was synchronous: give the retry a job for the same response
+		j := &job{id: e.customID, authHash: hashAuth(auth), status: jobPending}
+		if value, loaded := jobs.LoadOrStore(e.customID, j); loaded {
+			j = value.(*job)
+		} else {
+			safeGo(func() { j.complete(<-e.wait()) })
+		}
+		writeJobAccepted(w, j)
+		return
+	}
+
+	hb := startHeartbeat(w, stream)
+	waiter := e.wait()
+	select {
+	case response := <-waiter:
+		headersSent := hb.stop()
+		writeResponse(w, ep, response, stream, includeUsage, headersSent)
+	case <-r.Context().Done():
+		hb.stop()
+		e.stopWaiting(waiter)
+		log.WithField("requestID", e.customID).Info("Retrying client disconnected, the original request goes on")
+	}
+}
+
+// expireIdempotencyKeys forgets completed requests after the retention period
+func expireIdempotencyKeys() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			idempotencyKeys.Range(func(key, value interface{}) bool {
+				e := value.(*idempotentRequest)
+				e.mu.Lock()
+				expired := e.done && time.Since(e.completed) > idempotencyRetention
+				e.mu.Unlock()
+				if expired {
+					log.WithField("requestID", e.customID).Debug("Idempotency key expired")
+					idempotencyKeys.Delete(key)
+				}
+				return true
+			})
+		case <-shutdownChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimIdempotencyKey(t *testing.T) {
+	entry, owner, err := claimIdempotencyKey("Bearer a", "key-1", "hash-1", "req-1")
+	assert.NoError(t, err)
+	assert.True(t, owner)
+
+	retry, owner, err := claimIdempotencyKey("Bearer a", "key-1", "hash-1", "req-2")
+	assert.NoError(t, err)
+	assert.False(t, owner)
+	assert.Equal(t, "req-1", retry.customID)
+	waiter := retry.wait()
+
+	_, _, err = claimIdempotencyKey("Bearer a", "key-1", "hash-2", "req-3")
+	assert.ErrorIs(t, err, errIdempotencyMismatch)
+
+	// keys are scoped to the Authorization header
+	_, owner, err = claimIdempotencyKey("Bearer b", "key-1", "hash-2", "req-4")
+	assert.NoError(t, err)
+	assert.True(t, owner)
+
+	entry.complete(proxyResponse{StatusCode: 200, Body: "done"})
+	assert.Equal(t, "done", (<-waiter).Body)
+	assert.Equal(t, "done", (<-retry.wait()).Body)
+}
+
+func TestIdempotentRetryDisconnects(t *testing.T) {
+	entry, _, err := claimIdempotencyKey("Bearer a", "key-disconnect", "hash-1", "req-1")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		serveIdempotentRetry(httptest.NewRecorder(), r, entry, "Bearer a", endpointFor("/v1/chat/completions"), false, false, false)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { entry.mu.Lock(); defer entry.mu.Unlock(); return len(entry.waiters) == 1 }, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("still waiting for the original request")
+	}
+	entry.mu.Lock()
+	assert.Empty(t, entry.waiters)
+	entry.mu.Unlock()
+}
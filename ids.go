@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Request IDs (the custom_id of each batch line) are ULIDs prefixed with a
+// random per-process ID, e.g. "req_3f9a1c2e_01J9Z8Q5W3K4M7N8P9R0S1T2V3", so they
+// don't collide across requests, restarts or several proxies sharing an API key.
+
+// Clients can send their own X-Request-ID: it's logged along with our ID and echoed back
+const (
+	clientRequestIDHeader = "X-Request-ID"
+	proxyRequestIDHeader  = "X-Proxy-Request-ID"
+	maxClientRequestIDLen = 256
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var processPrefix = newProcessPrefix()
+
+func newProcessPrefix() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate process prefix: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newULID returns a 26 character ULID: 48 bits of millisecond timestamp and 80 random bits
+func newULID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixMilli())<<16)
+	if _, err := rand.Read(b[6:]); err != nil {
+		log.Fatalf("Failed to generate random ID: %v", err)
+	}
+
+	// 128 bits in groups of 5, most significant first (the first character only has 3 bits)
+	var sb strings.Builder
+	sb.Grow(26)
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	for i := 25; i >= 0; i-- {
+		shift := uint(i * 5)
+		var v uint64
+		switch {
+		case shift >= 64:
+			v = hi >> (shift - 64)
+		case shift > 59:
+			v = lo>>shift | hi<<(64-shift)
+		default:
+			v = lo >> shift
+		}
+		sb.WriteByte(crockford[v&0x1f])
+	}
+	return sb.String()
+}
+
+func newCustomID() string {
+	return "req_" + processPrefix + "_" + newULID()
+}
+
+// registerResponseChan assigns a new request ID to the response channel. IDs
+// shouldn't collide, but if they did one client would get another's response.
+func registerResponseChan(responseChan chan proxyResponse) string {
+	for {
+		customID := newCustomID()
+		if _, loaded := responseChanMap.LoadOrStore(customID, responseChan); !loaded {
+			return customID
+		}
+		log.WithField("requestID", customID).Error("Request ID collision, generating a new one")
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewULID(t *testing.T) {
+	seen := make(map[string]bool)
+	prev := ""
+	for i := 0; i < 10000; i++ {
+		id := newULID()
+		assert.Len(t, id, 26)
+		assert.False(t, seen[id], "duplicate ULID %s", id)
+		seen[id] = true
+		assert.LessOrEqual(t, prev[:min(len(prev), 10)], id[:10]) // timestamp part is sortable
+		prev = id
+	}
+}
@@ -19,7 +19,7 @@ func TestProxyIntegration(t *testing.T) {
 
 	var wg sync.WaitGroup
 
-	auth := "Bearer " + os.Getenv("OPENAI_API_KEY")
+	creds := credentials{auth: "Bearer " + os.Getenv("OPENAI_API_KEY")}
 
 	makeChatRequest := func(prompt string) {
 		payload := map[string]interface{}{
@@ -33,7 +33,7 @@ func TestProxyIntegration(t *testing.T) {
 			fmt.Println("Sending " + prompt)
 			defer wg.Done()
 
-			data, _, err := httpPost(proxyServer.URL+"/v1/chat/completions", auth, jsonPayload)
+			data, _, err := httpPost(proxyServer.URL+"/v1/chat/completions", creds, jsonPayload)
 			if err != nil {
 				t.Fatalf("Failed to make chat completion request: %v", err)
 			}
@@ -52,7 +52,7 @@ func TestProxyIntegration(t *testing.T) {
 			fmt.Println("Sending embedding " + input)
 			defer wg.Done()
 
-			data, _, err := httpPost(proxyServer.URL+"/v1/embeddings", auth, jsonPayload)
+			data, _, err := httpPost(proxyServer.URL+"/v1/embeddings", creds, jsonPayload)
 			if err != nil {
 				t.Fatalf("Failed to make chat completion request: %v", err)
 			}
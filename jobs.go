@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Asynchronous jobs: instead of holding the connection open until the batch
+// finishes, the proxy answers 202 Accepted with a job ID, and the client polls
+// /proxy/jobs/{id} for the result.
+
+const (
+	jobPath      = "/proxy/jobs/"
+	jobPending   = "pending"
+	jobCompleted = "completed"
+)
+
+var (
+	asyncJobs    = false // answer every batched request with a job, not only those with "Prefer: respond-async"
+	jobRetention = 24 * time.Hour
+	jobs         sync.Map // key: job ID (the customID of the request), value: *job
+)
+
+type job struct {
+	mu        sync.Mutex
+	id        string
+	authHash  string
+	durable   bool   // whether the request is in the journal
+	callback  string // URL to POST the response to when completed
+	status    string
+	response  proxyResponse
+	completed time.Time
+	fetched   bool
+}
+
+type jobStatus struct {
+	ID         string      `json:"id"`
+	Object     string      `json:"object"`
+	Status     string      `json:"status"`
+	StatusCode int         `json:"status_code,omitempty"` // of the response, once completed
+	Response   interface{} `json:"response,omitempty"`
+}
+
+// wantsAsync checks for "Prefer: respond-async" (RFC 7240)
+func wantsAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hashAuth(auth string) string {
+	sum := sha256.Sum256([]byte(auth))
+	return hex.EncodeToString(sum[:])
+}
+
+// newJob registers a pending job. durable tells whether the request is in the journal.
+func newJob(id, auth, callbackURL string, durable bool) *job {
+	j := &job{
+		id:       id,
+		authHash: hashAuth(auth),
+		durable:  durable && batchJournal != nil,
+		callback: callbackURL,
+		status:   jobPending,
+	}
+	jobs.Store(id, j)
+	return j
+}
+
+// startJob answers 202 Accepted and completes the job in the background with the result of fn
+func startJob(w http.ResponseWriter, j *job, start time.Time, fn func() proxyResponse) {
+	safeGo(func() {
+		response := fn()
+		j.complete(response)
+		trackRequestEnd(!response.isError(), time.Since(start))
+	})
+
+	log.WithField("requestID", j.id).Debug("Answered with a job")
+	writeJobAccepted(w, j)
+}
+
+func writeJobAccepted(w http.ResponseWriter, j *job) {
+	j.mu.Lock()
+	status := j.snapshot()
+	j.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", jobPath+j.id)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(status)
+}
+
+func (j *job) complete(response proxyResponse) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = jobCompleted
+	j.response = response
+	j.completed = time.Now()
+	if j.durable {
+		// kept in the journal until fetched, so that it survives a restart
+		batchJournal.resultStored(j.id, response)
+	}
+	if j.callback != "" {
+		safeGo2(deliverCallback)(j, response)
+	}
+}
+
+// reopen sets a completed job back to pending, when its request is replayed
+func (j *job) reopen() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.status = jobPending
+	j.response = proxyResponse{}
+	j.fetched = false
+}
+
+// markFetched records that the client got the result, so it's not kept across restarts
+func (j *job) markFetched() {
+	if !j.fetched {
+		j.fetched = true
+		batchJournal.requestDelivered(j.id)
+	}
+}
+
+func (j *job) snapshot() jobStatus {
+	return jobStatus{
+		ID:         j.id,
+		Object:     "proxy.job",
+		Status:     j.status,
+		StatusCode: j.response.StatusCode,
+		Response:   j.response.Body,
+	}
+}
+
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	value, ok := jobs.Load(r.PathValue("id"))
+	if !ok || value.(*job).authHash != hashAuth(r.Header.Get("Authorization")) {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	j := value.(*job)
+	j.mu.Lock()
+	status := j.snapshot()
+	if j.status == jobCompleted {
+		j.markFetched()
+	}
+	j.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// resumeJob recreates a job recovered from the journal
+func resumeJob(rec journalRecord, result *journalRecord) {
+	customID := rec.Request.CustomID
+	j := newJob(customID, rec.Auth, rec.Callback, true)
+	if result != nil {
+		// completed before the restart, but neither fetched nor called back
+		j.durable = false // already in the journal
+		j.complete(*result.Response)
+		j.completed = result.Time
+		return
+	}
+
+	responseChan := make(chan proxyResponse, 1)
+	responseChanMap.Store(customID, responseChan)
+	safeGo(func() {
+		defer responseChanMap.Delete(customID)
+		response, _ := awaitResponse(context.Background(), customID, responseChan, time.Time{})
+		j.complete(response)
+	})
+}
+
+// expireJobs forgets completed jobs after the retention period
+func expireJobs() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			jobs.Range(func(key, value interface{}) bool {
+				j := value.(*job)
+				j.mu.Lock()
+				expired := j.status == jobCompleted && time.Since(j.completed) > jobRetention
+				j.mu.Unlock()
+				if expired {
+					jobs.Delete(key)
+				}
+				return true
+			})
+		case <-shutdownChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJobLifecycle(t *testing.T) {
+	result := make(chan proxyResponse)
+	w := httptest.NewRecorder()
+	j := newJob("req_job", "Bearer a", "", false)
+	defer jobs.Delete(j.id)
+	startJob(w, j, time.Now(), func() proxyResponse { return <-result })
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, jobPath+"req_job", w.Header().Get("Location"))
+
+	get := func(auth string) (int, jobStatus) {
+		r := httptest.NewRequest(http.MethodGet, jobPath+j.id, nil)
+		r.SetPathValue("id", j.id)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		handleGetJob(w, r)
+		var status jobStatus
+		json.NewDecoder(w.Body).Decode(&status)
+		return w.Code, status
+	}
+
+	code, status := get("Bearer a")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, jobPending, status.Status)
+	assert.Nil(t, status.Response)
+
+	// jobs are only visible to the key that created them
+	code, _ = get("Bearer b")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	result <- proxyResponse{StatusCode: 200, Body: map[string]interface{}{"id": "chatcmpl-1"}}
+	assert.Eventually(t, func() bool { _, status := get("Bearer a"); return status.Status == jobCompleted }, time.Second, time.Millisecond)
+	_, status = get("Bearer a")
+	assert.Equal(t, 200, status.StatusCode)
+	assert.Equal(t, "chatcmpl-1", status.Response.(map[string]interface{})["id"])
+	j.mu.Lock()
+	assert.True(t, j.fetched)
+	j.mu.Unlock()
+
+	// replayed from the dead-letter queue: pending again
+	j.reopen()
+	_, status = get("Bearer a")
+	assert.Equal(t, jobPending, status.Status)
+}
+
+func TestWantsAsync(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	assert.False(t, wantsAsync(r))
+	r.Header.Set("Prefer", "return=minimal, Respond-Async")
+	assert.True(t, wantsAsync(r))
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The journal is an append-only JSONL file recording the lifecycle of every
+// batched request: queued -> uploaded -> batch created -> result -> delivered.
+// On startup it is replayed so that batches survive a crash or a deploy.
+//
+// Note the journal contains the Authorization header of each batch. Protect it
+// accordingly (it's created with 0600 permissions).
+
+const (
+	journalQueued        = "queued"         // request accepted, waiting to be batched
+	journalUploaded      = "uploaded"       // input file uploaded, batch not created yet
+	journalBatchCreated  = "batch_created"  // batch created, waiting for it to finish
+	journalBatchFinished = "batch_finished" // batch reached a final state and was processed
+	journalRequeued      = "requeued"       // request enqueued again for a new batch, before its batch finished
+	journalResult        = "result"         // response for a request nobody was waiting for
+	journalDelivered     = "delivered"      // response handed to the client
+)
+
+type journalRecord struct {
+	Type         string         `json:"type"`
+	Time         time.Time      `json:"time"`
+	Upstream     string         `json:"upstream,omitempty"`
+	Auth         string         `json:"auth,omitempty"`
+	Organization string         `json:"organization,omitempty"`
+	Project      string         `json:"project,omitempty"`
+	Endpoint     string         `json:"endpoint,omitempty"`
+	Model        string         `json:"model,omitempty"`
+	Hash         string         `json:"hash,omitempty"`
+	Async        bool           `json:"async,omitempty"`
+	Callback     string         `json:"callback,omitempty"`
+	Request      *ProxyRequest  `json:"request,omitempty"`
+	CustomID     string         `json:"custom_id,omitempty"`
+	CustomIDs    []string       `json:"custom_ids,omitempty"`
+	FileID       string         `json:"file_id,omitempty"`
+	BatchID      string         `json:"batch_id,omitempty"`
+	Response     *proxyResponse `json:"response,omitempty"`
+}
+
+type journal struct {
+	path          string
+	mu            sync.Mutex
+	file          *os.File
+	size          int64  // of the file
+	compactedSize int64  // of the file after the last compaction
+	written       uint64 // records written
+	syncMu        sync.Mutex
+	synced        uint64 // records synced
+}
+
+// journalCompactBytes is how much the journal grows past twice its compacted size before it's compacted again
+var journalCompactBytes int64 = 64 * 1024 * 1024
+
+// journalState is the live state rebuilt from the journal records
+type journalState struct {
+	requests map[string]journalRecord // key: customID
+	uploads  map[string]journalRecord // key: fileID
+	batches  map[string]journalRecord // key: batchID
+	results  map[string]journalRecord // key: customID
+	finished map[string]bool          // customIDs whose batch finished
+	requeued map[string]bool          // customIDs enqueued again, not done when their batch finishes
+}
+
+type storedResult struct {
+	response proxyResponse
+	time     time.Time
+}
+
+var (
+	batchJournal    *journal // nil when the journal is disabled
+	resultRetention = 24 * time.Hour
+	// key: request hash, value: customIDs of the requests recovered from the journal,
+	// as identical requests share a hash. Guarded by deliveryLock
+	recoveredRequests = make(map[string][]string)
+	orphanedResults   sync.Map // key: customID, value: storedResult. Responses nobody was waiting for
+)
+
+// requestHash identifies a request across restarts, so that a client retrying
+// the same request picks up the recovered one instead of enqueuing a new one.
+// The same body billed to another organization or project, or sent to another
+// upstream, is another request.
+func requestHash(creds credentials, endpoint string, body []byte) string {
+	h := sha256.New()
+	for _, s := range []string{creds.upstream, creds.auth, creds.organization, creds.project, endpoint} {
+		h.Write([]byte(s))
+		h.Write([]byte{'\n'})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func openJournal(path string) (*journal, *journalState, error) {
+	state, err := readJournal(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	j := &journal{path: path}
+	if err := j.compact(state); err != nil {
+		return nil, nil, err
+	}
+	return j, state, nil
+}
+
+func readJournal(path string) (*journalState, error) {
+	state := &journalState{
+		requests: make(map[string]journalRecord),
+		uploads:  make(map[string]journalRecord),
+		batches:  make(map[string]journalRecord),
+		results:  make(map[string]journalRecord),
+		finished: make(map[string]bool),
+		requeued: make(map[string]bool),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer f.Close()
+
+	// No limit on the size of a record: results (e.g. of embeddings) can be large
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var rec journalRecord
+			if err := json.Unmarshal(line, &rec); err != nil {
+				// most likely a torn write from a crash, the rest of the journal is still valid
+				log.Printf("[Journal] Skipping unreadable record: %v", err)
+			} else {
+				state.apply(rec)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read journal: %v", err)
+		}
+	}
+
+	// Requests in a finished batch with no stored result were already answered,
+	// unless they were uploaded again (held for the token limit, or requeued and batched since)
+	inFlight := state.inFlight()
+	for customID := range state.finished {
+		if _, ok := state.results[customID]; !ok && !inFlight[customID] {
+			delete(state.requests, customID)
+		}
+	}
+	for customID, rec := range state.results {
+		if time.Since(rec.Time) > resultRetention {
+			delete(state.results, customID)
+			delete(state.requests, customID)
+		}
+	}
+	// Uploads and batches whose requests were all answered (e.g. batch creation failed)
+	for fileID, rec := range state.uploads {
+		if !state.anyLive(rec.CustomIDs) {
+			delete(state.uploads, fileID)
+		}
+	}
+	for batchID, rec := range state.batches {
+		if !state.anyLive(rec.CustomIDs) {
+			delete(state.batches, batchID)
+		}
+	}
+	return state, nil
+}
+
+func (s *journalState) apply(rec journalRecord) {
+	switch rec.Type {
+	case journalQueued:
+		if rec.Request != nil {
+			s.requests[rec.Request.CustomID] = rec
+		}
+	case journalUploaded:
+		s.uploads[rec.FileID] = rec
+	case journalBatchCreated:
+		delete(s.uploads, rec.FileID)
+		s.batches[rec.BatchID] = rec
+	case journalBatchFinished:
+		if batch, ok := s.batches[rec.BatchID]; ok {
+			for _, customID := range batch.CustomIDs {
+				if s.requeued[customID] {
+					delete(s.requeued, customID) // it goes on in the next batch
+					continue
+				}
+				s.finished[customID] = true
+			}
+		}
+		delete(s.batches, rec.BatchID)
+	case journalRequeued:
+		s.requeued[rec.CustomID] = true
+	case journalResult:
+		if rec.Response != nil {
+			s.results[rec.CustomID] = rec
+		}
+	case journalDelivered:
+		delete(s.requests, rec.CustomID)
+		delete(s.results, rec.CustomID)
+		delete(s.finished, rec.CustomID)
+	}
+}
+
+func (s *journalState) anyLive(customIDs []string) bool {
+	for _, customID := range customIDs {
+		if _, ok := s.requests[customID]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inFlight returns the requests in live uploads and batches
+func (s *journalState) inFlight() map[string]bool {
+	inFlight := make(map[string]bool)
+	for _, rec := range s.uploads {
+		for _, customID := range rec.CustomIDs {
+			inFlight[customID] = true
+		}
+	}
+	for _, rec := range s.batches {
+		for _, customID := range rec.CustomIDs {
+			inFlight[customID] = true
+		}
+	}
+	return inFlight
+}
+
+// unbatched returns the requests that never made it into an uploaded file
+func (s *journalState) unbatched() []journalRecord {
+	inFlight := s.inFlight()
+	var recs []journalRecord
+	for customID, rec := range s.requests {
+		_, hasResult := s.results[customID]
+		if !inFlight[customID] && !s.finished[customID] && !hasResult {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
+
+// compact rewrites the journal with only the live state, and leaves it open for appending
+func (j *journal) compact(state *journalState) error {
+	tmpPath := j.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %v", err)
+	}
+
+	w := bufio.NewWriter(f)
+	var recs []journalRecord
+	for _, rec := range state.requests {
+		recs = append(recs, rec)
+	}
+	for _, rec := range state.uploads {
+		recs = append(recs, rec)
+	}
+	for _, rec := range state.batches {
+		recs = append(recs, rec)
+	}
+	for _, rec := range state.results {
+		recs = append(recs, rec)
+	}
+	for customID := range state.requeued {
+		recs = append(recs, journalRecord{Type: journalRequeued, Time: time.Now(), CustomID: customID})
+	}
+	var size int64
+	for _, rec := range recs {
+		data, err := json.Marshal(rec)
+		if err == nil {
+			_, err = w.Write(append(data, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to write journal: %v", err)
+		}
+		size += int64(len(data) + 1)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync journal: %v", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmpPath, j.path); err != nil {
+		return fmt.Errorf("failed to replace journal: %v", err)
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open journal for appending: %v", err)
+	}
+	j.size, j.compactedSize = size, size
+	return nil
+}
+
+// compactIfGrown compacts the journal once it has grown well past its live state,
+// which is read back from it
+func (j *journal) compactIfGrown() {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil || j.size <= 2*j.compactedSize+journalCompactBytes {
+		return // compacted meanwhile
+	}
+
+	state, err := readJournal(j.path)
+	if err == nil {
+		err = j.compact(state)
+	}
+	if err != nil {
+		log.Errorf("[Journal] Failed to compact: %v", err)
+		return
+	}
+	j.synced = j.written // compact syncs
+	log.WithField("bytes", j.size).Info("[Journal] Compacted")
+}
+
+func (j *journal) append(rec journalRecord) {
+	if j == nil {
+		return
+	}
+	rec.Time = time.Now()
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("[Journal] Failed to marshal %s record: %v", rec.Type, err)
+		return
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	if j.file == nil {
+		j.mu.Unlock()
+		log.Printf("[Journal] Journal closed, dropping %s record", rec.Type)
+		return
+	}
+	if _, err := j.file.Write(data); err != nil {
+		j.mu.Unlock()
+		log.Printf("[Journal] Failed to write %s record: %v", rec.Type, err)
+		return
+	}
+	j.size += int64(len(data))
+	j.written++
+	written := j.written
+	grown := j.size > 2*j.compactedSize+journalCompactBytes
+	j.mu.Unlock()
+
+	j.sync(written)
+	if grown {
+		j.compactIfGrown()
+	}
+}
+
+// sync makes the records up to the given one durable. Appends don't wait for each
+// other's fsync: the next one covers every record written meanwhile (group commit).
+func (j *journal) sync(record uint64) {
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	if j.synced >= record {
+		return
+	}
+	j.mu.Lock()
+	f, written := j.file, j.written
+	j.mu.Unlock()
+	if f == nil {
+		return
+	}
+	if err := f.Sync(); err != nil {
+		log.Printf("[Journal] Failed to sync: %v", err)
+		return
+	}
+	j.synced = written
+}
+
+func (j *journal) close() {
+	if j == nil {
+		return
+	}
+	j.syncMu.Lock()
+	defer j.syncMu.Unlock()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+}
+
+func (j *journal) requestQueued(key batchKey, hash string, req ProxyRequest, async bool, callbackURL string) {
+	rec := keyRecord(journalQueued, key)
+	rec.Hash, rec.Async, rec.Callback, rec.Request = hash, async, callbackURL, &req
+	j.append(rec)
+}
+
+func (j *journal) fileUploaded(fileID string, key batchKey, customIDs []string) {
+	rec := keyRecord(journalUploaded, key)
+	rec.FileID, rec.CustomIDs = fileID, customIDs
+	j.append(rec)
+}
+
+func (j *journal) batchCreated(batchID, fileID string, key batchKey, customIDs []string) {
+	rec := keyRecord(journalBatchCreated, key)
+	rec.BatchID, rec.FileID, rec.CustomIDs = batchID, fileID, customIDs
+	j.append(rec)
+}
+
+func (j *journal) batchFinished(batchID string) {
+	j.append(journalRecord{Type: journalBatchFinished, BatchID: batchID})
+}
+
+func (j *journal) requestRequeued(customID string) {
+	j.append(journalRecord{Type: journalRequeued, CustomID: customID})
+}
+
+func (j *journal) resultStored(customID string, response proxyResponse) {
+	j.append(journalRecord{Type: journalResult, CustomID: customID, Response: &response})
+}
+
+func (j *journal) requestDelivered(customID string) {
+	j.append(journalRecord{Type: journalDelivered, CustomID: customID})
+}
+
+// keyRecord is a record for the requests of a partition
+func keyRecord(recordType string, key batchKey) journalRecord {
+	return journalRecord{
+		Type:         recordType,
+		Upstream:     key.upstream,
+		Auth:         key.auth,
+		Organization: key.organization,
+		Project:      key.project,
+		Endpoint:     key.endpoint,
+		Model:        key.model,
+	}
+}
+
+// batchKey is the partition of the requests of a record
+func (rec journalRecord) batchKey() batchKey {
+	return batchKey{
+		credentials: credentials{upstream: upstreamNamed(rec.Upstream).Name, auth: rec.Auth, organization: rec.Organization, project: rec.Project},
+		endpoint:    rec.Endpoint,
+		model:       rec.Model,
+	}
+}
+
+// resumeFromJournal picks up where the previous process left off: unfinished
+// batches are polled again, uploaded files get their batch created, and
+// requests that were never batched are enqueued again
+func resumeFromJournal(state *journalState) {
+	for customID, rec := range state.requests {
+		result, hasResult := state.results[customID]
+		if !hasResult {
+			pendingRequests.Store(customID, *rec.Request)
+		}
+
+		if rec.Async {
+			// the client will come back polling for its job
+			if hasResult {
+				resumeJob(rec, &result)
+			} else {
+				resumeJob(rec, nil)
+			}
+			continue
+		}
+
+		deliveryLock.Lock()
+		if rec.Hash != "" {
+			recoveredRequests[rec.Hash] = append(recoveredRequests[rec.Hash], customID)
+		}
+		if hasResult {
+			orphanedResults.Store(customID, storedResult{response: *result.Response, time: result.Time})
+		}
+		deliveryLock.Unlock()
+	}
+
+	for _, rec := range state.batches {
+		log.WithFields(log.Fields{
+			"batchID":  rec.BatchID,
+			"requests": len(rec.CustomIDs),
+		}).Info("Resuming batch from journal")
+		trackBatchStart()
+		batchMap.Store(rec.BatchID, rec.batchKey().credentials)
+		safeGo4(processBatchResponse)(rec.BatchID, rec.batchKey(), rec.CustomIDs, rec.Time)
+	}
+
+	for _, rec := range state.uploads {
+		log.WithFields(log.Fields{
+			"fileID":   rec.FileID,
+			"requests": len(rec.CustomIDs),
+		}).Info("Resuming uploaded file from journal")
+		trackBatchStart()
+		safeGo1(func(rec journalRecord) {
+			createBatchAndProcess(rec.FileID, rec.batchKey(), rec.CustomIDs, rec.Time)
+		})(rec)
+	}
+
+	unbatched := state.unbatched()
+	if len(unbatched) > 0 {
+		log.WithField("requests", len(unbatched)).Info("Re-enqueuing unbatched requests from journal")
+	}
+	for _, rec := range unbatched {
+		enqueueRequest(rec.batchKey(), *rec.Request)
+	}
+}
+
+// attachRecoveredRequest reattaches a client retrying a request recovered from the
+// journal, so that it gets that request's response instead of enqueuing a new one.
+// Of identical requests, it prefers one with its response already there.
+func attachRecoveredRequest(hash string) (string, chan proxyResponse, bool) {
+	deliveryLock.Lock() // the response is either already stored, or delivered to the channel
+	defer deliveryLock.Unlock()
+	customIDs := recoveredRequests[hash]
+	if len(customIDs) == 0 {
+		return "", nil, false
+	}
+	i := 0
+	for j, customID := range customIDs {
+		if _, ok := orphanedResults.Load(customID); ok {
+			i = j
+			break
+		}
+	}
+	customID := customIDs[i]
+	if len(customIDs) == 1 {
+		delete(recoveredRequests, hash)
+	} else {
+		recoveredRequests[hash] = slices.Delete(slices.Clone(customIDs), i, i+1)
+	}
+	log.WithField("requestID", customID).Info("Request matches a recovered request, reattaching")
+
+	responseChan := make(chan proxyResponse, 1)
+	responseChanMap.Store(customID, responseChan)
+	if stored, ok := takeOrphanedResult(customID); ok {
+		responseChan <- stored
+	}
+	return customID, responseChan, true
+}
+
+// takeOrphanedResult returns (and forgets) a stored response for a recovered request
+func takeOrphanedResult(customID string) (proxyResponse, bool) {
+	value, ok := orphanedResults.LoadAndDelete(customID)
+	if !ok {
+		return proxyResponse{}, false
+	}
+	return value.(storedResult).response, true
+}
+
+// expireOrphanedResults forgets the results nobody picked up after the retention period
+func expireOrphanedResults() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sweepOrphanedResults()
+		case <-shutdownChan:
+			return
+		}
+	}
+}
+
+// sweepOrphanedResults drops the results stored longer than -result-retention ago,
+// along with the recovered requests a retrying client would attach to
+func sweepOrphanedResults() {
+	var expired []string
+	// a client attaching meanwhile takes the result first
+	deliveryLock.Lock()
+	hashes := make(map[string]string) // key: customID, value: request hash
+	for hash, customIDs := range recoveredRequests {
+		for _, customID := range customIDs {
+			hashes[customID] = hash
+		}
+	}
+	orphanedResults.Range(func(key, value interface{}) bool {
+		customID := key.(string)
+		if time.Since(value.(storedResult).time) <= resultRetention {
+			return true
+		}
+		if hash, ok := hashes[customID]; ok {
+			recoveredRequests[hash] = slices.DeleteFunc(recoveredRequests[hash], func(id string) bool { return id == customID })
+			if len(recoveredRequests[hash]) == 0 {
+				delete(recoveredRequests, hash)
+			}
+		}
+		orphanedResults.Delete(customID)
+		expired = append(expired, customID)
+		return true
+	})
+	deliveryLock.Unlock()
+
+	for _, customID := range expired {
+		batchJournal.requestDelivered(customID)
+	}
+	if len(expired) > 0 {
+		log.WithField("results", len(expired)).Info("Dropped results nobody picked up within the retention period")
+	}
+}
+
+func toSet(s []string) map[string]bool {
+	m := make(map[string]bool, len(s))
+	for _, k := range s {
+		m[k] = true
+	}
+	return m
+}
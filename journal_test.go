@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+
+	j, state, err := openJournal(path)
+	assert.NoError(t, err)
+	assert.Empty(t, state.requests)
+
+	key := batchKey{
+		credentials: credentials{upstream: "openai", auth: "Bearer x", organization: "org_1", project: "proj_1"},
+		endpoint:    "/v1/chat/completions",
+		model:       "gpt-4o-mini",
+	}
+	for _, id := range []string{"req_1", "req_2", "req_3", "req_4", "req_5"} {
+		j.requestQueued(key, "hash_"+id, ProxyRequest{CustomID: id, Method: "POST", Endpoint: key.endpoint}, false, "")
+	}
+	j.fileUploaded("file_1", key, []string{"req_1", "req_2"})
+	j.batchCreated("batch_1", "file_1", key, []string{"req_1", "req_2"})
+	j.fileUploaded("file_2", key, []string{"req_3"})
+	j.requestDelivered("req_5")
+	j.close()
+
+	// restart: batch_1 is resumed, file_2 gets its batch created, req_4 is enqueued again
+	j, state, err = openJournal(path)
+	assert.NoError(t, err)
+	assert.Len(t, state.requests, 4)
+	assert.Contains(t, state.batches, "batch_1")
+	assert.Equal(t, key, state.batches["batch_1"].batchKey())
+	assert.Contains(t, state.uploads, "file_2")
+	unbatched := state.unbatched()
+	assert.Len(t, unbatched, 1)
+	assert.Equal(t, "req_4", unbatched[0].Request.CustomID)
+
+	// batch_1 finishes: req_1 is delivered, req_2's client is gone so its result is kept
+	j.resultStored("req_2", proxyResponse{StatusCode: 200, Body: map[string]interface{}{"id": "chatcmpl-2"}})
+	j.requestDelivered("req_1")
+	j.batchFinished("batch_1")
+	j.close()
+
+	j, state, err = openJournal(path)
+	assert.NoError(t, err)
+	assert.NotContains(t, state.batches, "batch_1")
+	assert.NotContains(t, state.requests, "req_1")
+	assert.Contains(t, state.results, "req_2")
+	assert.Len(t, state.unbatched(), 1) // still only req_4, req_2 has a result waiting
+
+	// file_2's batch fails for the token limit and the file is held: req_3 is still live
+	j.batchCreated("batch_2", "file_2", key, []string{"req_3"})
+	j.fileUploaded("file_2", key, []string{"req_3"})
+	j.batchFinished("batch_2")
+	j.close()
+
+	_, state, err = openJournal(path)
+	assert.NoError(t, err)
+	assert.Contains(t, state.requests, "req_3")
+	assert.Contains(t, state.uploads, "file_2")
+}
+
+func TestSweepOrphanedResults(t *testing.T) {
+	response := proxyResponse{StatusCode: 200, Body: "done"}
+	orphanedResults.Store("req_old", storedResult{response: response, time: time.Now().Add(-resultRetention - time.Minute)})
+	orphanedResults.Store("req_new", storedResult{response: response, time: time.Now()})
+	recoveredRequests["hash_old"] = []string{"req_old"}
+	defer orphanedResults.Delete("req_new")
+
+	sweepOrphanedResults()
+	_, ok := orphanedResults.Load("req_old")
+	assert.False(t, ok)
+	_, _, ok = attachRecoveredRequest("hash_old")
+	assert.False(t, ok, "a retry doesn't attach to a request whose result is gone")
+	_, ok = orphanedResults.Load("req_new")
+	assert.True(t, ok)
+}
+
+func TestAttachIdenticalRecoveredRequests(t *testing.T) {
+	// two clients sent the same body before the restart; req_b's result is already there
+	recoveredRequests["hash_same"] = []string{"req_a", "req_b"}
+	orphanedResults.Store("req_b", storedResult{response: proxyResponse{StatusCode: 200, Body: "b"}, time: time.Now()})
+
+	customID, responseChan, ok := attachRecoveredRequest("hash_same")
+	assert.True(t, ok)
+	assert.Equal(t, "req_b", customID)
+	assert.Equal(t, "b", (<-responseChan).Body)
+	responseChanMap.Delete(customID)
+
+	customID, responseChan, ok = attachRecoveredRequest("hash_same")
+	assert.True(t, ok)
+	assert.Equal(t, "req_a", customID)
+	assert.True(t, deliverResponse("req_a", proxyResponse{StatusCode: 200, Body: "a"}))
+	assert.Equal(t, "a", (<-responseChan).Body)
+	responseChanMap.Delete(customID)
+
+	_, _, ok = attachRecoveredRequest("hash_same")
+	assert.False(t, ok, "each recovered request is attached to once")
+}
+
+func TestJournalRequeued(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := openJournal(path)
+	assert.NoError(t, err)
+
+	key := batchKey{credentials: credentials{upstream: "openai", auth: "Bearer x"}, endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	for _, id := range []string{"req_1", "req_2"} {
+		j.requestQueued(key, "hash_"+id, ProxyRequest{CustomID: id, Method: "POST", Endpoint: key.endpoint}, true, "")
+	}
+	j.fileUploaded("file_1", key, []string{"req_1", "req_2"})
+	j.batchCreated("batch_1", "file_1", key, []string{"req_1", "req_2"})
+	// req_1's line failed with a 429 and it's retried in the next batch; req_2 was answered
+	j.requestRequeued("req_1")
+	j.requestDelivered("req_2")
+	j.batchFinished("batch_1")
+	j.close()
+
+	// the retried request wasn't batched again before the restart: it's enqueued again
+	_, state, err := openJournal(path)
+	assert.NoError(t, err)
+	assert.Len(t, state.requests, 1)
+	unbatched := state.unbatched()
+	assert.Len(t, unbatched, 1)
+	assert.Equal(t, "req_1", unbatched[0].Request.CustomID)
+	assert.True(t, unbatched[0].Async, "still a job")
+}
+
+func TestRequestHash(t *testing.T) {
+	body := []byte(`{"model":"gpt-4o-mini"}`)
+	creds := credentials{upstream: "openai", auth: "Bearer x", organization: "org_1", project: "proj_1"}
+	hash := requestHash(creds, "/v1/chat/completions", body)
+	assert.Equal(t, hash, requestHash(creds, "/v1/chat/completions", body))
+
+	// the same body billed elsewhere, or sent to another upstream, is another request
+	for _, other := range []credentials{
+		{upstream: "openai", auth: "Bearer y", organization: "org_1", project: "proj_1"},
+		{upstream: "openai", auth: "Bearer x", organization: "org_2", project: "proj_1"},
+		{upstream: "openai", auth: "Bearer x", organization: "org_1", project: "proj_2"},
+		{upstream: "openai", auth: "Bearer x", organization: "org_1proj_1"},
+		{upstream: "groq", auth: "Bearer x", organization: "org_1", project: "proj_1"},
+	} {
+		assert.NotEqual(t, hash, requestHash(other, "/v1/chat/completions", body), "%+v", other)
+	}
+	assert.NotEqual(t, hash, requestHash(creds, "/v1/embeddings", body))
+}
+
+func TestJournalLargeRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := openJournal(path)
+	assert.NoError(t, err)
+
+	// a result larger than a batch, e.g. after lowering -max-batch-mb
+	key := batchKey{credentials: credentials{upstream: "openai", auth: "Bearer x"}, endpoint: "/v1/embeddings", model: "text-embedding-3-small"}
+	j.requestQueued(key, "hash_big", ProxyRequest{CustomID: "req_big", Method: "POST", Endpoint: key.endpoint}, true, "")
+	big := strings.Repeat("0.123,", 400*1024)
+	j.resultStored("req_big", proxyResponse{StatusCode: 200, Body: map[string]interface{}{"data": big}})
+	j.close()
+
+	// and a torn write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	f.WriteString(`{"type":"queued","request":{"cus`)
+	f.Close()
+
+	maxBatchMb = 1
+	defer func() { maxBatchMb = 25 }()
+	_, state, err := openJournal(path)
+	assert.NoError(t, err)
+	assert.Contains(t, state.results, "req_big")
+	assert.Equal(t, big, state.results["req_big"].Response.Body.(map[string]interface{})["data"])
+}
+
+func TestJournalCompactsAsItGrows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	j, _, err := openJournal(path)
+	assert.NoError(t, err)
+	journalCompactBytes = 16 * 1024
+	defer func() { journalCompactBytes = 64 * 1024 * 1024 }()
+
+	key := batchKey{credentials: credentials{upstream: "openai", auth: "Bearer x"}, endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	j.requestQueued(key, "hash_live", ProxyRequest{CustomID: "req_live", Method: "POST", Endpoint: key.endpoint}, true, "")
+	j.requestQueued(key, "hash_retried", ProxyRequest{CustomID: "req_retried", Method: "POST", Endpoint: key.endpoint}, true, "")
+	j.fileUploaded("file_1", key, []string{"req_retried"})
+	j.batchCreated("batch_1", "file_1", key, []string{"req_retried"})
+	j.requestRequeued("req_retried")
+
+	// many requests come and go, from concurrent handlers
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				id := fmt.Sprintf("req_%d_%d", i, n)
+				j.requestQueued(key, "hash_"+id, ProxyRequest{CustomID: id, Method: "POST", Endpoint: key.endpoint, Body: map[string]interface{}{"model": key.model}}, false, "")
+				j.requestDelivered(id)
+			}
+		}()
+	}
+	wg.Wait()
+	j.batchFinished("batch_1") // after a compaction, the retried request is still live
+	j.close()
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Less(t, info.Size(), 3*journalCompactBytes)
+	_, state, err := openJournal(path)
+	assert.NoError(t, err)
+	assert.Len(t, state.requests, 2)
+	assert.Len(t, state.unbatched(), 2)
+}
@@ -8,13 +8,21 @@ type ProxyRequest struct {
 }
 
 type BatchResponse struct {
-	ID            string        `json:"id"`
-	Object        string        `json:"object"`
-	Status        string        `json:"status"`
-	OutputFileID  *string       `json:"output_file_id"`
-	ErrorFileID   *string       `json:"error_file_id"`
-	RequestCounts RequestCounts `json:"request_counts"`
-	Error         *OpenAiError  `json:"error"`
+	ID            string            `json:"id"`
+	Object        string            `json:"object"`
+	Status        string            `json:"status"`
+	InputFileID   string            `json:"input_file_id"`
+	OutputFileID  *string           `json:"output_file_id"`
+	ErrorFileID   *string           `json:"error_file_id"`
+	RequestCounts RequestCounts     `json:"request_counts"`
+	Error         *OpenAiError      `json:"error"`
+	Errors        *BatchErrors      `json:"errors"` // validation errors of a failed batch
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+type BatchErrors struct {
+	Object string        `json:"object"`
+	Data   []OpenAiError `json:"data"`
 }
 
 type OpenAiError struct {
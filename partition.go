@@ -0,0 +1,143 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests are batched per partition: credentials (Authorization, OpenAI-Organization
+// and OpenAI-Project headers), endpoint and model. OpenAI rejects batches mixing
+// models, and its enqueued token limits are per model, so each partition has its
+// own batcher. -partition-limits overrides the batch limits for the partitions of
+// some models, e.g.
+//
+//   -partition-limits 'gpt-4o=size:200,mb:10,hold:10s;gpt-4o-mini=hold:1m'
+//
+// Limits not given fall back to those of the endpoint, if any, and then to
+// -max-batch-size, -max-batch-mb and -max-hold-batch.
+
+var (
+	partitionLimits = map[string]batchLimits{} // key: model
+	partitionDepths sync.Map                   // key: batchKey, value: *atomic.Int64 (requests enqueued, not yet submitted in a batch)
+)
+
+// batchLimits are the thresholds at which a batcher submits its batch. Zero means the global default.
+type batchLimits struct {
+	maxSize int
+	maxMb   int
+	maxHold time.Duration
+}
+
+// partitionStatus is how a partition is shown in /stats
+type partitionStatus struct {
+	Upstream string `json:"upstream"`
+	Key      string `json:"key"` // hash of the Authorization header
+	Project  string `json:"project,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Model    string `json:"model"`
+	Queued   int64  `json:"queued"`
+}
+
+// requestModel returns the model of a request body, or "" if it has none
+func requestModel(body interface{}) string {
+	if bodyMap, ok := body.(map[string]interface{}); ok {
+		model, _ := bodyMap["model"].(string)
+		return model
+	}
+	return ""
+}
+
+// limitsFor returns the batch limits of a partition: those of its model, else
+// those of its endpoint, else the global ones
+func limitsFor(key batchKey) batchLimits {
+	limits := partitionLimits[key.model]
+	var endpointLimits batchLimits
+	if e := endpointFor(key.endpoint); e != nil {
+		endpointLimits = e.limits
+	}
+	limits.maxSize = cmp.Or(limits.maxSize, endpointLimits.maxSize, maxBatchSize)
+	limits.maxMb = cmp.Or(limits.maxMb, endpointLimits.maxMb, maxBatchMb)
+	limits.maxHold = cmp.Or(limits.maxHold, endpointLimits.maxHold, maxHoldBatchSend)
+	return limits
+}
+
+// parsePartitionLimits parses -partition-limits: model=limit:value,...;model=...
+func parsePartitionLimits(s string) (map[string]batchLimits, error) {
+	limits := make(map[string]batchLimits)
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		model, settings, ok := strings.Cut(entry, "=")
+		model = strings.TrimSpace(model)
+		if !ok || model == "" {
+			return nil, fmt.Errorf("invalid partition %q, expected model=limit:value,...", entry)
+		}
+
+		var l batchLimits
+		for _, setting := range strings.Split(settings, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(setting), ":")
+			if !ok {
+				return nil, fmt.Errorf("invalid limit %q for model %s, expected limit:value", setting, model)
+			}
+			var err error
+			switch name {
+			case "size":
+				l.maxSize, err = strconv.Atoi(value)
+				if err == nil && l.maxSize <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "mb":
+				l.maxMb, err = strconv.Atoi(value)
+				if err == nil && l.maxMb <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			case "hold":
+				l.maxHold, err = time.ParseDuration(value)
+				if err == nil && l.maxHold <= 0 {
+					err = fmt.Errorf("must be positive")
+				}
+			default:
+				return nil, fmt.Errorf("unknown limit %q for model %s, must be size, mb or hold", name, model)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s for model %s: %v", name, model, err)
+			}
+		}
+		limits[model] = l
+	}
+	return limits, nil
+}
+
+func partitionDepth(key batchKey) *atomic.Int64 {
+	value, _ := partitionDepths.LoadOrStore(key, &atomic.Int64{})
+	return value.(*atomic.Int64)
+}
+
+func partitionStatuses() []partitionStatus {
+	statuses := []partitionStatus{}
+	partitionDepths.Range(func(k, value interface{}) bool {
+		key := k.(batchKey)
+		statuses = append(statuses, partitionStatus{
+			Upstream: upstreamNamed(key.upstream).Name,
+			Key:      hashAuth(key.auth)[:12],
+			Project:  key.project,
+			Endpoint: key.endpoint,
+			Model:    key.model,
+			Queued:   value.(*atomic.Int64).Load(),
+		})
+		return true
+	})
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		return a.Upstream+a.Key+a.Project+a.Endpoint+a.Model < b.Upstream+b.Key+b.Project+b.Endpoint+b.Model
+	})
+	return statuses
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionLimits(t *testing.T) {
+	limits, err := parsePartitionLimits("gpt-4o=size:200,mb:10,hold:10s; gpt-4o-mini=hold:1m")
+	assert.NoError(t, err)
+	assert.Equal(t, batchLimits{maxSize: 200, maxMb: 10, maxHold: 10 * time.Second}, limits["gpt-4o"])
+
+	partitionLimits = limits
+	defer func() { partitionLimits = map[string]batchLimits{} }()
+	mini := limitsFor(batchKey{model: "gpt-4o-mini"})
+	assert.Equal(t, batchLimits{maxSize: maxBatchSize, maxMb: maxBatchMb, maxHold: time.Minute}, mini)
+	assert.Equal(t, maxHoldBatchSend, limitsFor(batchKey{model: "o3"}).maxHold)
+
+	registerEndpoint(&endpoint{path: "/v1/test", limits: batchLimits{maxSize: 50, maxHold: time.Second}})
+	defer delete(endpoints, "/v1/test")
+	assert.Equal(t, batchLimits{maxSize: 50, maxMb: maxBatchMb, maxHold: time.Second}, limitsFor(batchKey{endpoint: "/v1/test", model: "o3"}))
+	assert.Equal(t, batchLimits{maxSize: 50, maxMb: maxBatchMb, maxHold: time.Minute}, limitsFor(batchKey{endpoint: "/v1/test", model: "gpt-4o-mini"}))
+
+	for _, invalid := range []string{"gpt-4o", "gpt-4o=size", "gpt-4o=size:0", "gpt-4o=tokens:5", "=hold:1s"} {
+		_, err := parsePartitionLimits(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
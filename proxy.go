@@ -9,23 +9,24 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
-const (
-	OpenAIBaseURL = "https://api.openai.com/v1"
-	SleepDuration = 5 * time.Second
-)
+const OpenAIBaseURL = "https://api.openai.com/v1"
 
+var SleepDuration = 5 * time.Second // between polls of the status of a batch
+
+// batchKey partitions the requests: a batch only has requests with the same key
 type batchKey struct {
-	auth     string
-	endpoint string
+	credentials // batches are billed to the organization and project of their requests
+	endpoint    string
+	model       string // OpenAI rejects batches mixing models
 }
 
 var (
@@ -36,7 +37,18 @@ var (
 	reqToBeBatchedMap sync.Map // key: batchKey, value: chan ProxyRequest
 	shutdownChan      = make(chan struct{})
 	responseChanMap   sync.Map // key: customID (id of a request), value: channel for the response
-	batchMap          sync.Map // key: BatchResponse.ID, value: auth. So that we can cancel them on ctrl-c
+	batchMap          sync.Map // key: BatchResponse.ID, value: credentials. So that we can cancel them on ctrl-c
+	pendingRequests   sync.Map // key: customID, value: ProxyRequest. Requests waiting for a response, for the synchronous fallback
+	withdrawnRequests sync.Map // key: customID. Requests whose client was served otherwise, their batch response is dropped
+	batchGracePeriod  time.Duration
+	shutdownMode      = shutdownCancel
+	detachTimeout     = time.Minute
+	batchSubmissions  sync.WaitGroup // batchers and batches being uploaded/created, so detach can wait for them
+)
+
+const (
+	shutdownCancel = "cancel" // cancel outstanding batches on shutdown
+	shutdownDetach = "detach" // leave them running, the next process resumes them from the journal
 )
 
 func init() {
@@ -53,10 +65,89 @@ func main() {
 	flag.DurationVar(&maxHoldBatchSend, "max-hold-batch", maxHoldBatchSend, "Maximum time to hold a batch before sending")
 	flag.IntVar(&maxBatchSize, "max-batch-size", maxBatchSize, "Maximum number of requests in a batch")
 	flag.IntVar(&maxBatchMb, "max-batch-mb", maxBatchMb, "Maximum size of a batch in bytes")
+	upstreamsFile := flag.String("upstreams", "", "Path of a JSON file defining the upstreams to batch with (OpenAI only if empty)")
+	limits := flag.String("partition-limits", "", "Batch limits for the partitions of some models, e.g. 'gpt-4o=size:200,mb:10,hold:10s;gpt-4o-mini=hold:1m'")
+	journalPath := flag.String("journal", "", "Path of the journal file used to resume batches after a restart (disabled if empty)")
+	flag.DurationVar(&resultRetention, "result-retention", resultRetention, "How long to keep results of recovered requests for clients to pick up")
+	flag.StringVar(&expiredPolicy, "expired-policy", expiredPolicy, "What to do with the requests of an expired batch without a result: resubmit, sync or fail")
+	flag.IntVar(&maxExpirations, "max-expirations", maxExpirations, "Number of expired batches after which a request is answered with an error (with -expired-policy resubmit)")
+	flag.IntVar(&maxRequestAttempts, "max-request-attempts", maxRequestAttempts, "Maximum batches a request is sent in when its line fails with a retryable status code")
+	retryCodes := flag.String("retry-status-codes", "429,500,502,503,504", "Comma-separated status codes of batch lines that are retried in the next batch")
+	deadLetterFile := flag.String("dead-letter-file", "", "Path of the file to keep the dead-letter queue in (in memory only if empty)")
+	flag.IntVar(&maxDeadLetters, "max-dead-letters", maxDeadLetters, "Maximum entries of the dead-letter queue, the oldest are dropped beyond")
+	flag.IntVar(&maxDeadLetterMb, "max-dead-letter-mb", maxDeadLetterMb, "Maximum size of the dead-letter queue in MB, the oldest entries are dropped beyond")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "Token required in the X-Proxy-Admin-Token header by the admin endpoints (disabled if empty)")
+	flag.IntVar(&upstreamMaxAttempts, "upstream-max-attempts", upstreamMaxAttempts, "Maximum attempts of a call to the Files/Batches API")
+	flag.DurationVar(&upstreamAttemptTimeout, "upstream-timeout", upstreamAttemptTimeout, "Timeout of each attempt of a call to the Files/Batches API")
+	flag.DurationVar(&upstreamDeadline, "upstream-deadline", upstreamDeadline, "Deadline of a call to the Files/Batches API, including its retries")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", breakerThreshold, "Consecutive batch API failures that open the circuit breaker")
+	flag.DurationVar(&breakerCooldown, "breaker-cooldown", breakerCooldown, "How long the circuit breaker stays open before probing the batch API again")
+	flag.StringVar(&breakerFallback, "breaker-fallback", breakerFallback, "What to do with requests while the circuit breaker is open: sync or fail (503)")
+	flag.IntVar(&breakerSyncBudget, "breaker-sync-budget", breakerSyncBudget, "Maximum requests sent synchronously per opening of the circuit breaker (0 for no limit)")
+	flag.DurationVar(&maxQuotaWait, "max-quota-wait", maxQuotaWait, "Maximum time to hold a batch that exceeded the enqueued token limit before answering its requests with an error")
+	flag.DurationVar(&batchGracePeriod, "batch-grace-period", batchGracePeriod, "Cancel batches not finished within this time and send the remaining requests through the synchronous API (0 disables)")
+	flag.BoolVar(&asyncJobs, "async-jobs", asyncJobs, "Answer every batched request with 202 Accepted and a job to poll, not only those with 'Prefer: respond-async'")
+	flag.DurationVar(&jobRetention, "job-retention", jobRetention, "How long to keep the result of a completed job")
+	flag.DurationVar(&idempotencyRetention, "idempotency-retention", idempotencyRetention, "How long to remember the response of a request with an Idempotency-Key")
+	flag.StringVar(&callbackSecret, "callback-secret", callbackSecret, "Secret to sign callback payloads with (HMAC-SHA256), unsigned if empty")
+	flag.IntVar(&callbackMaxAttempts, "callback-max-attempts", callbackMaxAttempts, "Maximum attempts to deliver a callback")
+	flag.DurationVar(&callbackTimeout, "callback-timeout", callbackTimeout, "Timeout of each attempt to deliver a callback")
+	allowHosts := flag.String("callback-allow-hosts", "", "Comma-separated hosts callbacks may be sent to even if they are loopback, link-local or private addresses")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", heartbeatInterval, "Send the response headers early and keep the connection alive writing whitespace at this interval (0 disables)")
+	flag.StringVar(&shutdownMode, "shutdown-mode", shutdownMode, "What to do with outstanding batches on shutdown: cancel or detach (requires -journal)")
+	flag.DurationVar(&detachTimeout, "detach-timeout", detachTimeout, "Maximum time to wait for pending batches to be created when detaching on shutdown")
 	flag.Parse()
 
+	switch shutdownMode {
+	case shutdownCancel:
+	case shutdownDetach:
+		if *journalPath == "" {
+			log.Fatal("-shutdown-mode detach requires -journal")
+		}
+	default:
+		log.Fatalf("Invalid -shutdown-mode %q, must be %s or %s", shutdownMode, shutdownCancel, shutdownDetach)
+	}
+	var err error
+	if retryStatusCodes, err = parseStatusCodes(*retryCodes); err != nil {
+		log.Fatalf("Invalid -retry-status-codes: %v", err)
+	}
+	callbackAllowHosts = parseHosts(*allowHosts)
+	if partitionLimits, err = parsePartitionLimits(*limits); err != nil {
+		log.Fatalf("Invalid -partition-limits: %v", err)
+	}
+	if *upstreamsFile != "" {
+		if err := loadUpstreams(*upstreamsFile); err != nil {
+			log.Fatalf("Invalid -upstreams: %v", err)
+		}
+	}
+	switch breakerFallback {
+	case breakerFallbackSync, breakerFallbackFail:
+	default:
+		log.Fatalf("Invalid -breaker-fallback %q, must be %s or %s", breakerFallback, breakerFallbackSync, breakerFallbackFail)
+	}
+	switch expiredPolicy {
+	case expiredResubmit, expiredSync, expiredFail:
+	default:
+		log.Fatalf("Invalid -expired-policy %q, must be %s, %s or %s", expiredPolicy, expiredResubmit, expiredSync, expiredFail)
+	}
+
 	log.Info("Starting server with maxHoldBatchSend: ", maxHoldBatchSend, ", maxBatchSize: ", maxBatchSize, ", maxBatchMb: ", maxBatchMb)
 
+	if *deadLetterFile != "" {
+		if err := openDeadLetters(*deadLetterFile); err != nil {
+			log.Fatalf("Failed to open dead-letter queue: %v", err)
+		}
+	}
+
+	var journalState *journalState
+	if *journalPath != "" {
+		var err error
+		if batchJournal, journalState, err = openJournal(*journalPath); err != nil {
+			log.Fatalf("Failed to open journal: %v", err)
+		}
+		defer batchJournal.close()
+	}
+
 	server := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: createMuxServer(),
@@ -69,6 +160,13 @@ func main() {
 		}
 	}()
 
+	if journalState != nil {
+		resumeFromJournal(journalState)
+	}
+	safeGo(expireJobs)
+	safeGo(expireIdempotencyKeys)
+	safeGo(expireOrphanedResults)
+
 	// graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -78,9 +176,15 @@ func main() {
 	log.Info("Shutting down server...")
 
 	// signal all goroutines to stop
+	stopIntake()
 	close(shutdownChan)
 
-	cancelAllOutstandingBatches()
+	if shutdownMode == shutdownDetach {
+		detachOutstandingBatches()
+	} else {
+		cancelAllOutstandingBatches()
+	}
+	cancelUpstream() // give up on the upstream calls still retrying
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
@@ -94,9 +198,16 @@ func main() {
 
 func createMuxServer() *http.ServeMux {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/v1/chat/completions", handleOpenaiPostEndpoint)
-	mux.HandleFunc("/v1/embeddings", handleOpenaiPostEndpoint)
+	for _, path := range batchPaths() {
+		mux.HandleFunc(path, handleOpenaiPostEndpoint)
+	}
+	mux.HandleFunc("/proxy/bulk", handleBulk)
 	mux.HandleFunc("/stats", handleStats)
+	mux.HandleFunc(jobPath+"{id}", handleGetJob)
+	mux.HandleFunc("/proxy/callbacks/failed", handleFailedCallbacks)
+	mux.HandleFunc(deadLetterPath, handleDeadLetters)
+	mux.HandleFunc(deadLetterPath+"/{id}", handleDeadLetter)
+	mux.HandleFunc(deadLetterPath+"/{id}/replay", handleReplayDeadLetter)
 	mux.HandleFunc("/", handleNoopOpenaiProxy)
 	return mux
 }
@@ -106,17 +217,17 @@ func cancelAllOutstandingBatches() {
 
 	batchMap.Range(func(key, value interface{}) bool {
 		batchID := key.(string)
-		auth := value.(string)
+		creds := value.(credentials)
 
 		wg.Add(1)
-		safeGo2(func(id, auth string) {
+		safeGo2(func(id string, creds credentials) {
 			defer wg.Done()
 			log.Printf("Cancelling batch %s", id)
-			if err := cancelBatch(id, auth); err != nil {
+			if err := cancelBatch(id, creds); err != nil {
 				log.Printf("Error cancelling batch %s: %v", id, err)
 			}
 			// http requests to this proxy in the batch will error out when the server shuts down
-		})(batchID, auth)
+		})(batchID, creds)
 
 		return true
 	})
@@ -125,65 +236,328 @@ func cancelAllOutstandingBatches() {
 	wg.Wait()
 }
 
+// detachOutstandingBatches leaves the batches running in OpenAI so that the
+// next process takes them over from the journal
+func detachOutstandingBatches() {
+	// batchers flush their buffered requests on shutdown; wait for those batches to be created
+	done := make(chan struct{})
+	safeGo(func() {
+		batchSubmissions.Wait()
+		close(done)
+	})
+	select {
+	case <-done:
+	case <-time.After(detachTimeout):
+		log.Warn("Timed out waiting for pending batches to be created, they'll be resubmitted on next start")
+	}
+
+	batchMap.Range(func(key, value interface{}) bool {
+		log.WithField("batchID", key).Info("Detaching batch, it will be resumed on next start")
+		return true
+	})
+
+	// everything is in the journal by now; stop writing so it's left consistent for the next process
+	batchJournal.close()
+}
+
 func handleOpenaiPostEndpoint(w http.ResponseWriter, r *http.Request) {
 	trackRequestStart()
 	start := time.Now()
 
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, errCodeInvalidRequest, "Method not allowed")
 		return
 	}
 
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Errorf("Failed to read request body: %v", err)
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Failed to read request body")
 		return
 	}
 	defer r.Body.Close()
 
-	customID := fmt.Sprintf("req_%d", rand.Intn(1000000))
-	log.WithField("requestID", customID).Debugf("New request received for endpoint: %s", r.URL.Path)
+	clientRequestID := r.Header.Get(clientRequestIDHeader)
+	if len(clientRequestID) > maxClientRequestIDLen {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("%s header is too long", clientRequestIDHeader))
+		return
+	}
+	if clientRequestID != "" {
+		w.Header().Set(clientRequestIDHeader, clientRequestID)
+	}
 
-	responseChan := make(chan interface{})
-	responseChanMap.Store(customID, responseChan)
-	defer responseChanMap.Delete(customID)
+	maxWait, err := parseMaxWait(r.Header.Get(maxWaitHeader))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s header: %v", maxWaitHeader, err))
+		return
+	}
 
 	var bodyMap map[string]interface{}
 	if err := json.Unmarshal(body, &bodyMap); err != nil {
-		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, "Failed to parse request body")
 		return
 	}
+	// batches can't stream: the stream is emulated once the response is available
+	ep := endpointFor(r.URL.Path)
+	stream, includeUsage := ep.prepareBody(bodyMap)
 
 	key := batchKey{
-		auth:     r.Header.Get("Authorization"),
-		endpoint: r.URL.Path,
+		credentials: credentialsOf(r.Header),
+		endpoint:    r.URL.Path,
+		model:       requestModel(bodyMap),
+	}
+	up, err := routeUpstream(r.Header, key.model)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s header: %v", upstreamHeader, err))
+		return
+	}
+	key.upstream = up.Name
+	if !up.batches(key.endpoint) {
+		log.WithField("upstream", up.Name).Debug("Upstream doesn't batch this endpoint, relaying the request")
+		forwardRequest(w, r, bytes.NewReader(body), up, key.model)
+		trackRequestEnd(true, time.Since(start))
+		return
+	}
+	hash := requestHash(key.credentials, key.endpoint, body)
+
+	callbackURL := r.Header.Get(callbackHeader)
+	if callbackURL != "" {
+		if err := validateCallbackURL(callbackURL); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s header: %v", callbackHeader, err))
+			return
+		}
+	}
+	async := asyncJobs || wantsAsync(r) || callbackURL != ""
+
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	var idem *idempotentRequest // nil unless this request owns an Idempotency-Key
+
+	customID, responseChan, recovered := attachRecoveredRequest(hash)
+	if !recovered {
+		reason := ""
+		if breakerFor(key).isOpen() {
+			if !breakerFor(key).takeSyncBudget() {
+				response := unavailableResponse()
+				writeError(w, response.StatusCode, errCodeBatchUnavailable, response.errorMessage())
+				trackRequestEnd(false, time.Since(start))
+				return
+			}
+			reason = "Circuit breaker open"
+		} else if maxWait > 0 && expectedBatchTurnaround(key) > maxWait {
+			reason = "Batch turnaround can't meet the deadline"
+		}
+		sendSync := reason != ""
+		if sendSync && !async && idempotencyKey == "" {
+			log.WithField("maxWait", maxWait).Info(reason + ", sending synchronously")
+			serveSynchronously(w, r, body, up, key.model)
+			trackRequestEnd(true, time.Since(start))
+			return
+		}
+
+		if sendSync {
+			customID = newCustomID()
+		} else {
+			// buffered, so that the response can be delivered even if we stopped waiting for it
+			responseChan = make(chan proxyResponse, 1)
+			customID = registerResponseChan(responseChan)
+		}
+
+		if idempotencyKey != "" {
+			entry, owner, err := claimIdempotencyKey(key.auth, idempotencyKey, hash, customID)
+			if err != nil || !owner {
+				responseChanMap.Delete(customID)
+			}
+			if err != nil {
+				writeError(w, http.StatusUnprocessableEntity, errCodeIdempotencyMismatch, err.Error())
+				return
+			}
+			if !owner {
+				log.WithFields(log.Fields{
+					"requestID":       entry.customID,
+					"clientRequestID": clientRequestID,
+				}).Info("Retried request with the same Idempotency-Key, reattaching")
+				serveIdempotentRetry(w, r, entry, key.auth, ep, async, stream, includeUsage)
+				trackRequestEnd(true, time.Since(start))
+				return
+			}
+			idem = entry
+		}
+
+		if sendSync {
+			w.Header().Set(proxyRequestIDHeader, customID)
+			log.WithFields(log.Fields{
+				"requestID":       customID,
+				"clientRequestID": clientRequestID,
+				"maxWait":         maxWait,
+			}).Info(reason + ", sending synchronously")
+			fetch := func() proxyResponse {
+				response := fetchSynchronously(customID, key.credentials, key.endpoint, bodyMap)
+				idem.complete(response)
+				return response
+			}
+			if async {
+				startJob(w, newJob(customID, key.auth, callbackURL, false), start, fetch)
+				return
+			}
+			response := fetch()
+			trackRequestEnd(!response.isError(), time.Since(start))
+			writeResponse(w, ep, response, stream, includeUsage, false)
+			return
+		}
+
+		log.WithFields(log.Fields{
+			"requestID":       customID,
+			"clientRequestID": clientRequestID,
+		}).Debugf("New request received for endpoint: %s", r.URL.Path)
+
+		req := ProxyRequest{
+			CustomID: customID,
+			Method:   "POST",
+			Endpoint: r.URL.Path,
+			Body:     bodyMap,
+		}
+
+		batchJournal.requestQueued(key, hash, req, async, callbackURL)
+		enqueueRequest(key, req)
+		log.WithField("requestID", customID).Debug("Request sent to be batched")
 	}
 
-	req := ProxyRequest{
-		CustomID: customID,
-		Method:   "POST",
-		Endpoint: r.URL.Path,
-		Body:     bodyMap,
+	w.Header().Set(proxyRequestIDHeader, customID)
+
+	var deadline time.Time
+	if maxWait > 0 {
+		deadline = start.Add(maxWait)
 	}
 
-	value, loaded := reqToBeBatchedMap.LoadOrStore(key, make(chan ProxyRequest, 1))
-	ch := value.(chan ProxyRequest)
-	if !loaded {
-		log.Printf("[%s] Created a new channel for %+v", customID, key)
-		safeGo2(processUploadAndCreateBatch)(key, ch)
+	if async {
+		startJob(w, newJob(customID, key.auth, callbackURL, true), start, func() proxyResponse {
+			defer responseChanMap.Delete(customID)
+			response, ok := awaitResponse(context.Background(), customID, responseChan, deadline)
+			if !ok {
+				log.WithField("requestID", customID).Info("Deadline passed while waiting for the batch, sending job synchronously")
+				response = fetchSynchronously(customID, key.credentials, key.endpoint, bodyMap)
+			}
+			idem.complete(response)
+			return response
+		})
+		return
 	}
-	ch <- req
-	log.WithField("requestID", customID).Debug("Request sent to be batched")
+	defer responseChanMap.Delete(customID)
 
-	response := <-responseChan
+	// a request with an Idempotency-Key is kept even if its client goes away, a retry may attach to it
+	ctx := r.Context()
+	if idem != nil {
+		ctx = context.Background()
+	}
+
+	hb := startHeartbeat(w, stream)
+	response, ok := awaitResponse(ctx, customID, responseChan, deadline)
+	headersSent := hb.stop()
+	batchJournal.requestDelivered(customID)
+	if !ok && ctx.Err() != nil {
+		log.WithField("requestID", customID).Info("Client disconnected, abandoning the request")
+		trackRequestAbandoned()
+		return
+	}
+	if !ok {
+		log.WithField("requestID", customID).Info("Deadline passed while waiting for the batch, sending synchronously")
+		if !headersSent && idem == nil {
+			serveSynchronously(w, r, body, up, key.model)
+			trackRequestEnd(true, time.Since(start))
+			return
+		}
+		// the response has to be captured: the status and headers are gone, or retries need it
+		response = fetchSynchronously(customID, key.credentials, key.endpoint, bodyMap)
+	}
 	log.WithField("requestID", customID).Debug("Received response from batch")
+	idem.complete(response)
 
-	trackRequestEnd(true, time.Since(start))
+	trackRequestEnd(!response.isError(), time.Since(start))
+	writeResponse(w, ep, response, stream, includeUsage, headersSent)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(response)
+// writeResponse writes the response as JSON, or as an emulated stream if the client asked for one
+func writeResponse(w http.ResponseWriter, ep *endpoint, response proxyResponse, stream, includeUsage, headersSent bool) {
+	if stream && (headersSent || !response.isError()) {
+		writeEmulatedStream(w, ep, response, includeUsage, headersSent)
+		return
+	}
+
+	if !headersSent {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(response.StatusCode)
+	}
+	json.NewEncoder(w).Encode(response.Body)
+}
+
+// awaitResponse waits for the batch response of a request. If the deadline (zero
+// means none) passes or ctx is done first, the request is withdrawn from its batch
+// and ok is false.
+func awaitResponse(ctx context.Context, customID string, responseChan chan proxyResponse, deadline time.Time) (response proxyResponse, ok bool) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case response = <-responseChan:
+		return response, true
+	case <-timeout:
+		return withdrawRequest(customID, responseChan)
+	case <-ctx.Done():
+		return withdrawRequest(customID, responseChan)
+	}
+}
+
+// intakeClosed is set, under intakeLock, once shutdown begins: no batcher is started
+// nor request handed to one after that, so that detach's wait on batchSubmissions
+// covers every batch
+var (
+	intakeLock   sync.RWMutex
+	intakeClosed bool
+)
+
+// stopIntake stops enqueuing requests, before the batchers are told to flush
+func stopIntake() {
+	intakeLock.Lock()
+	defer intakeLock.Unlock()
+	intakeClosed = true
+}
+
+// turnAway answers the client of a request that won't be batched because the proxy is shutting down
+func turnAway(customID string) {
+	log.WithField("requestID", customID).Warn("Shutting down, request not batched")
+	pendingRequests.Delete(customID)
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	handOver(customID, errorResponse(http.StatusServiceUnavailable, errCodeShuttingDown, "The proxy is shutting down, retry the request"))
+}
+
+// enqueueRequest hands a request to the batcher for its key, starting one if needed.
+// Once shutting down, its client is answered right away instead; the request is
+// left in the journal for the next process.
+func enqueueRequest(key batchKey, req ProxyRequest) {
+	intakeLock.RLock()
+	defer intakeLock.RUnlock()
+	if intakeClosed {
+		turnAway(req.CustomID)
+		return
+	}
+	pendingRequests.Store(req.CustomID, req)
+	partitionDepth(key).Add(1)
+	value, loaded := reqToBeBatchedMap.LoadOrStore(key, make(chan ProxyRequest, 1))
+	ch := value.(chan ProxyRequest)
+	if !loaded {
+		log.Printf("[%s] Created a new channel for %+v", req.CustomID, key)
+		batchSubmissions.Add(1)
+		safeGo(func() {
+			defer batchSubmissions.Done()
+			processUploadAndCreateBatch(key, ch)
+		})
+	}
+	ch <- req
 }
 
 func handleStats(w http.ResponseWriter, r *http.Request) {
@@ -202,8 +576,11 @@ func processUploadAndCreateBatch(key batchKey, reqToBeBatched chan ProxyRequest)
 	var jsonlData bytes.Buffer
 	batchSize := 0
 	batchBytes := 0
-	maxBatchBytes := maxBatchMb * 1024 * 1024
+	limits := limitsFor(key)
+	maxBatchBytes := limits.maxMb * 1024 * 1024
 	batchStart := time.Now()
+	depth := partitionDepth(key)
+	up := upstreamNamed(key.upstream)
 
 	log.Printf("[Batch] Starting new batch for key %+v", key)
 
@@ -214,18 +591,20 @@ func processUploadAndCreateBatch(key batchKey, reqToBeBatched chan ProxyRequest)
 				"requestID": req.CustomID,
 				"key":       key,
 			}).Debug("New request added to batch")
-			jsonReq, err := json.Marshal(req)
+			jsonReq, err := json.Marshal(up.batchLine(req))
 			if err != nil {
 				log.Printf("[Batch] Failed to marshal proxy request: %v", err)
+				depth.Add(-1)
 				continue
 			}
 
 			jsonReq = append(jsonReq, '\n') // JSONL: each JSON in a new line
 
-			if batchSize >= maxBatchSize || batchBytes+len(jsonReq) > maxBatchBytes || len(batch) == 0 && len(jsonReq) > maxBatchBytes {
+			if batchSize >= limits.maxSize || batchBytes+len(jsonReq) > maxBatchBytes || len(batch) == 0 && len(jsonReq) > maxBatchBytes {
 				if len(batch) > 0 {
 					log.Printf("[Batch] Batch full, processing %d requests", len(batch))
-					safeGo4(processBatch)(jsonlData.Bytes(), key.auth, key.endpoint, outstandingCustomIDs(batch))
+					depth.Add(-int64(len(batch)))
+					submitBatch(jsonlData.Bytes(), key, batch)
 					batch = nil
 					jsonlData.Reset()
 					batchSize = 0
@@ -245,12 +624,13 @@ func processUploadAndCreateBatch(key batchKey, reqToBeBatched chan ProxyRequest)
 			}).Debug("Current batch status")
 
 		case <-time.After(200 * time.Millisecond):
-			if len(batch) > 0 && (time.Since(batchStart) >= maxHoldBatchSend || batchSize >= maxBatchSize) {
+			if len(batch) > 0 && (time.Since(batchStart) >= limits.maxHold || batchSize >= limits.maxSize) {
 				log.WithFields(log.Fields{
 					"requests":       len(batch),
 					"timeSinceStart": time.Since(batchStart),
 				}).Info("Processing batch due to time or size limit")
-				safeGo4(processBatch)(jsonlData.Bytes(), key.auth, key.endpoint, outstandingCustomIDs(batch))
+				depth.Add(-int64(len(batch)))
+				submitBatch(jsonlData.Bytes(), key, batch)
 				batch = nil
 				jsonlData.Reset()
 				batchSize = 0
@@ -262,7 +642,13 @@ func processUploadAndCreateBatch(key batchKey, reqToBeBatched chan ProxyRequest)
 			log.Info("Received shutdown signal")
 			if len(batch) > 0 {
 				log.WithField("requests", len(batch)).Info("Processing final batch before shutdown")
-				safeGo4(processBatch)(jsonlData.Bytes(), key.auth, key.endpoint, outstandingCustomIDs(batch))
+				depth.Add(-int64(len(batch)))
+				submitBatch(jsonlData.Bytes(), key, batch)
+			}
+			// intake is stopped by now: these were handed over just before
+			for len(reqToBeBatched) > 0 {
+				turnAway((<-reqToBeBatched).CustomID)
+				depth.Add(-1)
 			}
 			reqToBeBatchedMap.Delete(key)
 			return
@@ -270,47 +656,131 @@ func processUploadAndCreateBatch(key batchKey, reqToBeBatched chan ProxyRequest)
 	}
 }
 
-func processBatch(jsonlData []byte, auth, endpoint string, outstandingCustomIDs map[string]bool) {
+// submitBatch uploads and creates the batch in the background
+func submitBatch(jsonlData []byte, key batchKey, batch []ProxyRequest) {
+	jsonlData, batch = dropWithdrawnRequests(jsonlData, key, batch)
+	if len(batch) == 0 {
+		log.Printf("[Batch] All requests were withdrawn, nothing to submit for key %+v", key)
+		return
+	}
+	if !breakerFor(key).allowBatch() {
+		safeGo2(fallbackBatch)(key, batch)
+		return
+	}
+	jsonlData = bytes.Clone(jsonlData) // the caller reuses its buffer for the next batch
+	customIDs := requestIDs(batch)
+	batchSubmissions.Add(1)
+	safeGo(func() {
+		defer batchSubmissions.Done()
+		processBatch(jsonlData, key, customIDs)
+	})
+}
+
+// dropWithdrawnRequests removes the requests whose clients stopped waiting before
+// the batch was uploaded, rebuilding the JSONL only if there are any
+func dropWithdrawnRequests(jsonlData []byte, key batchKey, batch []ProxyRequest) ([]byte, []ProxyRequest) {
+	var kept []ProxyRequest
+	for _, req := range batch {
+		if _, ok := withdrawnRequests.LoadAndDelete(req.CustomID); ok {
+			log.WithField("requestID", req.CustomID).Debug("Request withdrawn, removed from batch before upload")
+			continue
+		}
+		kept = append(kept, req)
+	}
+	if len(kept) == len(batch) {
+		return jsonlData, batch
+	}
+
+	return marshalBatch(key, kept), kept
+}
+
+// marshalBatch builds the JSONL input file of a batch
+func marshalBatch(key batchKey, batch []ProxyRequest) []byte {
+	up := upstreamNamed(key.upstream)
+	var buf bytes.Buffer
+	for _, req := range batch {
+		jsonReq, _ := json.Marshal(up.batchLine(req)) // already marshalled successfully when batched
+		buf.Write(jsonReq)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// processBatch uploads the JSONL and creates the batch. customIDs are the requests
+// in the order of the lines in the file.
+func processBatch(jsonlData []byte, key batchKey, customIDs []string) {
 	trackBatchStart()
 	start := time.Now()
-	log.WithField("requests", len(outstandingCustomIDs)).Info("Starting to process batch")
+	log.WithField("requests", len(customIDs)).Info("Starting to process batch")
 
-	fileID, err := uploadFile(jsonlData, auth)
+	fileID, err := uploadFile(jsonlData, key.credentials)
 	if err != nil {
+		breakerFor(key).record(err)
 		log.WithError(err).Error("Failed to upload file to OpenAI")
-		sendErrorToAllRequests(outstandingCustomIDs, fmt.Sprintf("Failed to upload file: %v", err))
+		sendErrorToAllRequests(toSet(customIDs), key, upstreamErrorResponse(err, errCodeUploadFailed, "Failed to upload file"))
 		trackBatchEnd(false, time.Since(start))
 		return
 	}
 	log.WithField("fileID", fileID).Info("File uploaded successfully")
+	batchJournal.fileUploaded(fileID, key, customIDs)
+
+	createBatchAndProcess(fileID, key, customIDs, start)
+}
 
-	batchID, err := createBatch(fileID, auth, endpoint)
+func createBatchAndProcess(fileID string, key batchKey, customIDs []string, start time.Time) {
+	batchID, err := createBatch(fileID, key.credentials, key.endpoint)
+	breakerFor(key).record(err)
+	if isTokenLimitError(err) {
+		holdBatch(key, fileID, customIDs, start)
+		return
+	}
 	if err != nil {
 		log.Printf("[ProcessBatch] Failed to create batch: %v", err)
-		if err := deleteFile(fileID, auth); err != nil {
+		if err := deleteFile(fileID, key.credentials); err != nil {
 			log.Printf("[ProcessBatch] Warning: Failed to delete input file: %v", err)
 		}
-		sendErrorToAllRequests(outstandingCustomIDs, fmt.Sprintf("Failed to create batch: %v", err))
+		sendErrorToAllRequests(toSet(customIDs), key, upstreamErrorResponse(err, errCodeCreateFailed, "Failed to create batch"))
 		trackBatchEnd(false, time.Since(start))
 		return
 	}
 	log.Printf("[ProcessBatch] Batch created successfully, ID: %s", batchID)
+	batchJournal.batchCreated(batchID, fileID, key, customIDs)
+	for _, customID := range customIDs {
+		requestBatchIDs.Store(customID, batchID)
+	}
 
 	// Store the batch ID and headers for potential cancellation
-	batchMap.Store(batchID, auth)
+	batchMap.Store(batchID, key.credentials)
 
-	safeGo4(processBatchResponse)(batchID, auth, outstandingCustomIDs, start)
+	safeGo4(processBatchResponse)(batchID, key, customIDs, start)
 }
 
-func processBatchResponse(batchID, auth string, outstandingCustomIDs map[string]bool, start time.Time) {
+func processBatchResponse(batchID string, key batchKey, customIDs []string, start time.Time) {
 	defer batchMap.Delete(batchID)
+	outstandingCustomIDs := toSet(customIDs)
 
 	log.WithField("batchID", batchID).Info("Starting to process batch response")
 
-	batchResponse, err := pollBatchStatus(batchID, auth)
+	var deadline time.Time
+	if batchGracePeriod > 0 {
+		deadline = start.Add(batchGracePeriod)
+	}
+
+	q := quotaQueueFor(key)
+	q.batchStarted()
+
+	batchResponse, err := pollBatchStatus(batchID, key.credentials, deadline)
+	// only a batch that ran frees capacity for the batches held for the token limit
+	defer func() { q.batchDone(err == nil && batchResponse.Status != "failed") }()
+	if errors.Is(err, errDetached) {
+		log.WithField("batchID", batchID).Info("Stopped polling detached batch")
+		return
+	}
+	defer batchJournal.batchFinished(batchID)
 	if err != nil {
+		breakerFor(key).record(err)
 		log.WithError(err).Error("Failed batch or batch status")
-		sendErrorToAllRequests(outstandingCustomIDs, fmt.Sprintf("Batch processing failed: %v", err))
+		sendErrorToAllRequests(outstandingCustomIDs, key, upstreamErrorResponse(err, errCodeStatusFailed, "Batch processing failed"))
 		trackBatchEnd(false, time.Since(start))
 		return
 	}
@@ -321,6 +791,17 @@ func processBatchResponse(batchID, auth string, outstandingCustomIDs map[string]
 		"errorFileID":  batchResponse.ErrorFileID,
 	}).Info("Batch status received")
 
+	// Over the enqueued token limit, nothing ran: create the batch again when there's capacity
+	if batchResponse.Status == "failed" && tokenLimitExceeded(batchResponse) && batchResponse.InputFileID != "" {
+		batchJournal.fileUploaded(batchResponse.InputFileID, key, customIDs)
+		holdBatch(key, batchResponse.InputFileID, customIDs, start)
+		return
+	}
+	batchRan(batchResponse.InputFileID)
+	if batchResponse.Status == "completed" {
+		trackBatchCompleted(time.Since(start))
+	}
+
 	filesToProcess := []*string{batchResponse.OutputFileID, batchResponse.ErrorFileID}
 
 	var waitDelete sync.WaitGroup
@@ -330,7 +811,7 @@ func processBatchResponse(batchID, auth string, outstandingCustomIDs map[string]
 			continue
 		}
 
-		jsonlContent, err := readFile(*fileID, auth)
+		jsonlContent, err := readFile(*fileID, key.credentials)
 		if err != nil {
 			log.Printf("[ProcessBatchResponse] Failed to retrieve file %s: %v", *fileID, err)
 			continue
@@ -340,25 +821,44 @@ func processBatchResponse(batchID, auth string, outstandingCustomIDs map[string]
 		waitDelete.Add(1)
 		safeGo1(func(id string) {
 			defer waitDelete.Done()
-			if err := deleteFile(id, auth); err != nil {
+			if err := deleteFile(id, key.credentials); err != nil {
 				log.Printf("[ProcessBatchResponse] Warning: Failed to delete file %s: %v", id, err)
 			}
 		})(*fileID)
 
-		processFileContent(jsonlContent, outstandingCustomIDs)
+		processFileContent(jsonlContent, key, outstandingCustomIDs)
+	}
+
+	// One invalid request fails the validation of the whole batch: answer it and resubmit the rest
+	if batchResponse.Status == "failed" && len(outstandingCustomIDs) > 0 {
+		isolateInvalidRequests(batchResponse, key, customIDs, outstandingCustomIDs)
+	}
+
+	// The output of an expired batch is partial: the rest is resubmitted or sent synchronously, per -expired-policy
+	if batchResponse.Status == "expired" && len(outstandingCustomIDs) > 0 {
+		handleExpiredRequests(batchID, key, customIDs, outstandingCustomIDs)
 	}
 
-	// Send error responses for any remaining outstanding requests. Shouldn't happen
+	// The batch was cancelled for exceeding its grace period: send the rest through the synchronous API
+	if batchResponse.Status == "cancelled" && !deadline.IsZero() && time.Now().After(deadline) && len(outstandingCustomIDs) > 0 {
+		log.WithFields(log.Fields{
+			"batchID":  batchID,
+			"requests": len(outstandingCustomIDs),
+		}).Info("Sending requests without a result through the synchronous API")
+		sendAllSynchronously(outstandingCustomIDs, key)
+	}
+
+	// Send error responses for any remaining outstanding requests. Shouldn't happen for completed batches
 	for customID := range outstandingCustomIDs {
 		log.Printf("[ProcessBatchResponse] Sending error response for outstanding request ID: %s", customID)
-		sendErrorResponse(customID, "No response received for request ["+customID+"] in the batch")
+		sendErrorResponse(customID, key, missingResponse(customID, batchResponse))
 	}
 
 	trackBatchEnd(true, time.Since(start))
 	log.WithField("batchID", batchID).Info("Finished processing batch response")
 }
 
-func processFileContent(jsonlContent []byte, outstandingCustomIDs map[string]bool) {
+func processFileContent(jsonlContent []byte, key batchKey, outstandingCustomIDs map[string]bool) {
 	for _, line := range bytes.Split(jsonlContent, []byte("\n")) {
 		if len(line) == 0 {
 			continue
@@ -372,62 +872,155 @@ func processFileContent(jsonlContent []byte, outstandingCustomIDs map[string]boo
 
 		log.Printf("[ProcessFileContent] Processing response for request ID: %s", reqResponse.CustomID)
 
-		if ch, ok := responseChanMap.Load(reqResponse.CustomID); ok {
-			if reqResponse.Error != nil {
-				ch.(chan interface{}) <- map[string]interface{}{
-					"error": reqResponse.Error,
-				}
-			} else {
-				ch.(chan interface{}) <- reqResponse.Response.Body
-			}
-			close(ch.(chan interface{}))
+		if !outstandingCustomIDs[reqResponse.CustomID] {
+			log.Printf("[ProcessFileContent] No waiting request found for CustomID: %s", reqResponse.CustomID)
+			continue
+		}
+
+		if notRun(reqResponse.Error) {
+			continue // handled according to the batch status (grace period, expired policy)
+		}
+
+		response := normalizeResponse(reqResponse.Response.StatusCode, reqResponse.Response.Body)
+		if reqResponse.Error != nil {
+			response = batchLineErrorResponse(reqResponse.Error)
+		}
+		if response.isError() && retryFailedLine(reqResponse.CustomID, key, response) {
 			delete(outstandingCustomIDs, reqResponse.CustomID)
+			continue
+		}
+		if retryStatusCodes[response.StatusCode] {
+			addDeadLetter(reqResponse.CustomID, key, response) // out of attempts
+		}
+		if deliverResponse(reqResponse.CustomID, response) {
 			log.Printf("[ProcessFileContent] Response sent for request ID: %s", reqResponse.CustomID)
 		} else {
-			log.Printf("[ProcessFileContent] No waiting request found for CustomID: %s", reqResponse.CustomID)
+			log.Printf("[ProcessFileContent] Response stored for request ID: %s", reqResponse.CustomID)
 		}
+		delete(outstandingCustomIDs, reqResponse.CustomID)
 	}
 }
 
-func outstandingCustomIDs(batch []ProxyRequest) map[string]bool {
-	m := make(map[string]bool)
+// deliverResponse hands the response to the waiting client. If nobody is waiting
+// (the request was recovered from the journal), the response is kept so that the
+// client can pick it up when it retries. Returns whether a client was waiting.
+func deliverResponse(customID string, response proxyResponse) bool {
+	pendingRequests.Delete(customID)
+	forgetAttempts(customID)
+	requestBatchIDs.Delete(customID)
+	deliveryLock.Lock()
+	withdrawn, delivered := handOver(customID, response)
+	if !withdrawn && !delivered {
+		orphanedResults.Store(customID, storedResult{response: response, time: time.Now()})
+	}
+	deliveryLock.Unlock()
+	if withdrawn {
+		return false // the client was already served some other way
+	}
+	if delivered {
+		return true
+	}
+	batchJournal.resultStored(customID, response)
+	return false
+}
+
+// deliveryLock makes withdrawing a request, or attaching to a recovered one, and
+// handing over its response atomic: either the request is withdrawn first, and its
+// response dropped, or its client gets it (stored if it attaches later)
+var deliveryLock sync.Mutex
+
+// handOver sends the response to the channel of the client waiting for it, unless
+// the request was withdrawn. Must hold deliveryLock.
+func handOver(customID string, response proxyResponse) (withdrawn, delivered bool) {
+	if _, ok := withdrawnRequests.LoadAndDelete(customID); ok {
+		return true, false
+	}
+	value, ok := responseChanMap.Load(customID)
+	if !ok {
+		return false, false
+	}
+	ch := value.(chan proxyResponse)
+	ch <- response // buffered, a request has a single response
+	close(ch)
+	return false, true
+}
+
+// requestIDs returns the custom IDs of the batch, in order
+func requestIDs(batch []ProxyRequest) []string {
+	customIDs := make([]string, 0, len(batch))
 	for _, req := range batch {
-		m[req.CustomID] = true
+		customIDs = append(customIDs, req.CustomID)
 	}
-	return m
+	return customIDs
 }
 
-// Helper function to send error response for an individual request
-func sendErrorResponse(customID string, errorMsg string) {
-	log.Printf("[ErrorResponse] Sending error response for request ID: %s, Error: %s", customID, errorMsg)
-	if ch, ok := responseChanMap.Load(customID); ok {
-		ch.(chan interface{}) <- map[string]interface{}{
-			"error": map[string]string{
-				"message": errorMsg,
-			},
-		}
-		close(ch.(chan interface{}))
+// withdrawRequest stops waiting for the batch response of a request; it will be
+// dropped when it arrives. If the response arrived in the meantime, it's returned.
+func withdrawRequest(customID string, responseChan chan proxyResponse) (proxyResponse, bool) {
+	pendingRequests.Delete(customID)
+
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+	responseChanMap.Delete(customID)
+	select {
+	case response := <-responseChan:
+		return response, true
+	default:
+		withdrawnRequests.Store(customID, true)
+		return proxyResponse{}, false
+	}
+}
+
+// Helper function to send error response for an individual request. The request is dead-lettered.
+func sendErrorResponse(customID string, key batchKey, response proxyResponse) {
+	addDeadLetter(customID, key, response)
+	log.Printf("[ErrorResponse] Sending error response for request ID: %s, Status: %d, Error: %s", customID, response.StatusCode, response.errorMessage())
+	if deliverResponse(customID, response) {
 		log.Printf("[ErrorResponse] Error response sent and channel closed for request ID: %s", customID)
 	} else {
-		log.Printf("[ErrorResponse] No response channel found for request ID: %s\n", customID)
+		log.Printf("[ErrorResponse] No response channel found for request ID: %s, response stored\n", customID)
 	}
 	trackSynthesizedErrorResponse()
 }
 
 // Helper function to send error responses for all requests in a batch
-func sendErrorToAllRequests(customIDs map[string]bool, errorMsg string) {
-	log.Printf("[BatchError] Sending error to %d requests: %s", len(customIDs), errorMsg)
+func sendErrorToAllRequests(customIDs map[string]bool, key batchKey, response proxyResponse) {
+	log.Printf("[BatchError] Sending error to %d requests: %s", len(customIDs), response.errorMessage())
 	for customID := range customIDs {
-		sendErrorResponse(customID, errorMsg)
+		sendErrorResponse(customID, key, response)
 	}
 }
 
 // any other endpoint we don't handle, forward transparently
 func handleNoopOpenaiProxy(w http.ResponseWriter, r *http.Request) {
-	log.WithField("path", r.URL.Path).Info("Forwarding request to OpenAI")
-	openAIURL := "https://api.openai.com" + r.URL.Path
+	up, err := routeUpstream(r.Header, "")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidRequest, fmt.Sprintf("Invalid %s header: %v", upstreamHeader, err))
+		return
+	}
+	forwardRequest(w, r, r.Body, up, "")
+}
+
+// forwardedHeader tells whether a header of the client is relayed upstream: not
+// its key, which is sent the way the upstream expects it, nor those meant for the proxy
+func forwardedHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name != "Authorization" && name != idempotencyKeyHeader && !strings.HasPrefix(name, "X-Proxy-")
+}
 
-	proxyReq, err := http.NewRequest(r.Method, openAIURL, r.Body)
+// forwardRequest relays the request to the upstream as-is, but for its credentials.
+// model is that of the request, if known.
+func forwardRequest(w http.ResponseWriter, r *http.Request, body io.Reader, up *upstream, model string) {
+	log.WithFields(log.Fields{
+		"path":     r.URL.Path,
+		"upstream": up.Name,
+	}).Info("Forwarding request upstream")
+	upstreamURL := up.url(r.URL.Path, model)
+	if r.URL.RawQuery != "" {
+		upstreamURL = withQuery(upstreamURL, r.URL.RawQuery)
+	}
+
+	proxyReq, err := http.NewRequest(r.Method, upstreamURL, body)
 	if err != nil {
 		log.Printf("[NoopProxy] Error creating proxy request: %v", err)
 		http.Error(w, "Error creating proxy request", http.StatusInternalServerError)
@@ -435,19 +1028,26 @@ func handleNoopOpenaiProxy(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for name, values := range r.Header {
+		if !forwardedHeader(name) {
+			continue
+		}
 		for _, value := range values {
 			proxyReq.Header.Add(name, value)
 		}
 	}
+	up.setAuth(proxyReq.Header, r.Header.Get("Authorization"))
 	resp, err := httpClient.Do(proxyReq)
 	if err != nil {
-		log.Printf("[NoopProxy] Error forwarding request to OpenAI: %v", err)
-		http.Error(w, "Error forwarding request to OpenAI", http.StatusBadGateway)
+		log.Printf("[NoopProxy] Error forwarding request to %s: %v", up.Name, err)
+		http.Error(w, "Error forwarding request to "+up.Name, http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
 	for name, values := range resp.Header {
+		if _, ok := w.Header()[name]; ok {
+			continue // already set by the proxy (e.g. echoing X-Request-ID)
+		}
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
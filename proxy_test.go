@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// responseID is the id of the completion in a response
+func responseID(response proxyResponse) string {
+	body, _ := response.Body.(map[string]interface{})
+	id, _ := body["id"].(string)
+	return id
+}
+
+func TestGracePeriodFallback(t *testing.T) {
+	api, key := newFakeBatchAPI(t, func(requests []ProxyRequest, cancelled bool) (string, []string) {
+		if !cancelled {
+			return "", nil
+		}
+		return "cancelled", []string{outputLine(requests[0].CustomID), errorLine(requests[1].CustomID, errCodeBatchCancelled)}
+	})
+	batchGracePeriod = time.Millisecond
+	defer func() { batchGracePeriod = 0 }()
+
+	batchID, waiting := startBatch(t, key, "req_ran", "req_cancelled")
+	processBatchResponse(batchID, key, []string{"req_ran", "req_cancelled"}, time.Now())
+
+	assert.Equal(t, "chatcmpl-batch", responseID(<-waiting["req_ran"]))
+	assert.Equal(t, "chatcmpl-sync", responseID(<-waiting["req_cancelled"]), "the cancelled line is sent synchronously, not answered with its error")
+	_, _, syncCalls := api.counts()
+	assert.Equal(t, 1, syncCalls)
+}
+
+func TestWithdrawAndDeliverRace(t *testing.T) {
+	response := proxyResponse{StatusCode: 200, Body: map[string]interface{}{"id": "chatcmpl-1"}}
+	for i := 0; i < 1000; i++ {
+		customID := newCustomID()
+		responseChan := make(chan proxyResponse, 1)
+		responseChanMap.Store(customID, responseChan)
+		pendingRequests.Store(customID, ProxyRequest{CustomID: customID})
+
+		delivered := make(chan bool)
+		go func() { delivered <- deliverResponse(customID, response) }()
+		got, ok := withdrawRequest(customID, responseChan)
+
+		// either the client got the response, or it was dropped: never stored for nobody
+		assert.Equal(t, ok, <-delivered)
+		if ok {
+			assert.Equal(t, response, got)
+		}
+		_, orphaned := orphanedResults.Load(customID)
+		assert.False(t, orphaned)
+		_, withdrawn := withdrawnRequests.Load(customID)
+		assert.False(t, withdrawn)
+	}
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	stopIntake()
+	defer func() { intakeClosed = false }()
+
+	key := batchKey{credentials: credentials{upstream: "openai", auth: "Bearer x"}, endpoint: "/v1/chat/completions", model: "gpt-4o-mini"}
+	responseChan := make(chan proxyResponse, 1)
+	customID := registerResponseChan(responseChan)
+	defer responseChanMap.Delete(customID)
+	enqueueRequest(key, ProxyRequest{CustomID: customID})
+
+	response := <-responseChan
+	assert.Equal(t, 503, response.StatusCode)
+	_, batching := reqToBeBatchedMap.Load(key)
+	assert.False(t, batching, "no batcher is started once shutting down")
+	_, pending := pendingRequests.Load(customID)
+	assert.False(t, pending)
+}
+
+func TestExpiredBatchPolicies(t *testing.T) {
+	// the first batch expires after running its first request, the next ones complete
+	expireFirst := func() func([]ProxyRequest, bool) (string, []string) {
+		batches := 0
+		return func(requests []ProxyRequest, cancelled bool) (string, []string) {
+			batches++
+			if batches == 1 {
+				return "expired", []string{outputLine(requests[0].CustomID), errorLine(requests[1].CustomID, errCodeBatchExpired)}
+			}
+			var output []string
+			for _, req := range requests {
+				output = append(output, outputLine(req.CustomID))
+			}
+			return "completed", output
+		}
+	}
+	defer func() { expiredPolicy = expiredResubmit }()
+
+	t.Run("sync", func(t *testing.T) {
+		api, key := newFakeBatchAPI(t, expireFirst())
+		expiredPolicy = expiredSync
+		batchID, waiting := startBatch(t, key, "req_expired_ran", "req_expired_sync")
+		processBatchResponse(batchID, key, []string{"req_expired_ran", "req_expired_sync"}, time.Now())
+
+		assert.Equal(t, "chatcmpl-batch", responseID(<-waiting["req_expired_ran"]))
+		assert.Equal(t, "chatcmpl-sync", responseID(<-waiting["req_expired_sync"]))
+		_, _, syncCalls := api.counts()
+		assert.Equal(t, 1, syncCalls)
+	})
+
+	t.Run("resubmit", func(t *testing.T) {
+		api, key := newFakeBatchAPI(t, expireFirst())
+		expiredPolicy = expiredResubmit
+		batchID, waiting := startBatch(t, key, "req_expired_ran_2", "req_expired_resubmitted")
+		processBatchResponse(batchID, key, []string{"req_expired_ran_2", "req_expired_resubmitted"}, time.Now())
+
+		assert.Equal(t, "chatcmpl-batch", responseID(<-waiting["req_expired_ran_2"]))
+		select {
+		case response := <-waiting["req_expired_resubmitted"]:
+			assert.Equal(t, "chatcmpl-batch", responseID(response), "answered by the next batch")
+		case <-time.After(5 * time.Second):
+			t.Fatal("the expired request wasn't resubmitted")
+		}
+		uploads, _, syncCalls := api.counts()
+		assert.Equal(t, 2, uploads)
+		assert.Equal(t, 0, syncCalls)
+		// the next batch is processed in the background: it's done once its output file (file-4) is deleted
+		assert.Eventually(t, func() bool { return api.isDeleted("file-4") }, 5*time.Second, 5*time.Millisecond)
+	})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenAI limits the tokens enqueued in batches per organization and model. Past
+// the limit, new batches fail with token_limit_exceeded, which says nothing about
+// the requests themselves: the proxy holds the uploaded file and creates the batch
+// again once a batch in flight for the same partition completes (or every
+// quotaRetryInterval if there's none), for up to -max-quota-wait.
+
+var (
+	maxQuotaWait       = time.Hour
+	quotaRetryInterval = time.Minute // to retry when there's no batch in flight to wait for
+	quotaQueues        sync.Map      // key: batchKey, value: *quotaQueue
+	heldFiles          sync.Map      // key: input file ID, value: *heldBatch. Kept across retries until the batch runs
+)
+
+// quotaQueue tracks the batches in flight for a partition, and those held waiting for capacity
+type quotaQueue struct {
+	mu       sync.Mutex
+	inFlight int
+	held     []*heldBatch
+}
+
+type heldBatch struct {
+	key       batchKey
+	fileID    string
+	customIDs []string
+	start     time.Time
+	heldSince time.Time
+	attempts  int
+	retry     chan struct{} // signaled when a batch in flight completes
+}
+
+// heldBatchStatus is how a held batch is shown in /stats
+type heldBatchStatus struct {
+	Endpoint  string    `json:"endpoint"`
+	Model     string    `json:"model"`
+	FileID    string    `json:"file_id"`
+	Requests  int       `json:"requests"`
+	Attempts  int       `json:"attempts"`
+	HeldSince time.Time `json:"held_since"`
+}
+
+func quotaQueueFor(key batchKey) *quotaQueue {
+	value, _ := quotaQueues.LoadOrStore(key, &quotaQueue{})
+	return value.(*quotaQueue)
+}
+
+func (q *quotaQueue) batchStarted() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight++
+}
+
+// batchDone is called when a batch in flight reaches a final state. If it ran (so
+// it freed enqueued tokens), the oldest held batch gets to retry.
+func (q *quotaQueue) batchDone(freedCapacity bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight--
+	if !freedCapacity {
+		return
+	}
+	for _, h := range q.held {
+		select {
+		case h.retry <- struct{}{}:
+			return
+		default: // already signaled, try the next one
+		}
+	}
+}
+
+// tokenLimitExceeded tells whether a batch failed for exceeding the enqueued token limit
+func tokenLimitExceeded(batch *BatchResponse) bool {
+	if batch.Error != nil && batch.Error.Code == errCodeTokenLimitExceeded {
+		return true
+	}
+	if batch.Errors != nil {
+		for _, e := range batch.Errors.Data {
+			if e.Code == errCodeTokenLimitExceeded {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isTokenLimitError tells whether creating a batch was rejected for exceeding the enqueued token limit
+func isTokenLimitError(err error) bool {
+	var statusErr *httpStatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	var body struct {
+		Error *OpenAiError `json:"error"`
+	}
+	return json.Unmarshal(statusErr.Body, &body) == nil && body.Error != nil && body.Error.Code == errCodeTokenLimitExceeded
+}
+
+// holdBatch keeps an uploaded file until there's capacity to create its batch
+func holdBatch(key batchKey, fileID string, customIDs []string, start time.Time) {
+	log.WithFields(log.Fields{
+		"fileID":   fileID,
+		"endpoint": key.endpoint,
+		"model":    key.model,
+		"requests": len(customIDs),
+	}).Warn("Enqueued token limit exceeded, holding the batch until there's capacity")
+
+	value, _ := heldFiles.LoadOrStore(fileID, &heldBatch{
+		key:       key,
+		fileID:    fileID,
+		customIDs: customIDs,
+		start:     start,
+		heldSince: time.Now(),
+		retry:     make(chan struct{}, 1),
+	})
+	h := value.(*heldBatch) // held before: keeps counting from the first time
+	q := quotaQueueFor(key)
+	q.mu.Lock()
+	q.held = append(q.held, h)
+	q.mu.Unlock()
+
+	safeGo(func() { q.waitAndRetry(h) })
+}
+
+// waitAndRetry creates the held batch again when signaled, or periodically if
+// nothing is in flight. Past -max-quota-wait, the requests are answered with an error.
+func (q *quotaQueue) waitAndRetry(h *heldBatch) {
+	ticker := time.NewTicker(quotaRetryInterval)
+	defer ticker.Stop()
+	giveUp := time.NewTimer(time.Until(h.heldSince.Add(maxQuotaWait)))
+	defer giveUp.Stop()
+
+	for {
+		select {
+		case <-h.retry:
+		case <-ticker.C:
+			q.mu.Lock()
+			waiting := q.inFlight > 0
+			q.mu.Unlock()
+			if waiting {
+				continue // a batch completing will signal us
+			}
+		case <-giveUp.C:
+			q.release(h)
+			heldFiles.Delete(h.fileID)
+			log.WithField("fileID", h.fileID).Error("Gave up waiting for enqueued token capacity")
+			if err := deleteFile(h.fileID, h.key.credentials); err != nil {
+				log.Printf("[Quota] Warning: Failed to delete input file: %v", err)
+			}
+			sendErrorToAllRequests(toSet(h.customIDs), h.key, errorResponse(http.StatusTooManyRequests, errCodeTokenLimitExceeded,
+				fmt.Sprintf("Enqueued token limit for model %q still exceeded after waiting %s", h.key.model, maxQuotaWait)))
+			trackBatchEnd(false, time.Since(h.start))
+			return
+		case <-shutdownChan:
+			return // the file stays in the journal as uploaded
+		}
+
+		q.mu.Lock()
+		h.attempts++
+		q.mu.Unlock()
+		q.release(h)
+		log.WithField("fileID", h.fileID).Info("Retrying to create held batch")
+		createBatchAndProcess(h.fileID, h.key, h.customIDs, h.start)
+		return
+	}
+}
+
+// batchRan forgets a held batch once it was created and didn't fail for the token limit
+func batchRan(fileID string) {
+	heldFiles.Delete(fileID)
+}
+
+// release removes a batch from the held queue
+func (q *quotaQueue) release(h *heldBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, held := range q.held {
+		if held == h {
+			q.held = append(q.held[:i], q.held[i+1:]...)
+			return
+		}
+	}
+}
+
+// heldBatches lists the batches waiting for enqueued token capacity, oldest first
+func heldBatches() []heldBatchStatus {
+	held := []heldBatchStatus{}
+	quotaQueues.Range(func(_, value interface{}) bool {
+		q := value.(*quotaQueue)
+		q.mu.Lock()
+		for _, h := range q.held {
+			held = append(held, heldBatchStatus{
+				Endpoint:  h.key.endpoint,
+				Model:     h.key.model,
+				FileID:    h.fileID,
+				Requests:  len(h.customIDs),
+				Attempts:  h.attempts,
+				HeldSince: h.heldSince,
+			})
+		}
+		q.mu.Unlock()
+		return true
+	})
+	sort.Slice(held, func(i, j int) bool { return held[i].HeldSince.Before(held[j].HeldSince) })
+	return held
+}
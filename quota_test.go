@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuotaQueueRelease(t *testing.T) {
+	q := &quotaQueue{}
+	first := &heldBatch{fileID: "file_1", retry: make(chan struct{}, 1)}
+	second := &heldBatch{fileID: "file_2", retry: make(chan struct{}, 1)}
+	q.held = []*heldBatch{first, second}
+	signaled := func(h *heldBatch) bool {
+		select {
+		case <-h.retry:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// a batch that failed freed no capacity
+	q.batchStarted()
+	q.batchDone(false)
+	assert.False(t, signaled(first))
+	assert.False(t, signaled(second))
+
+	// each batch that ran lets one held batch retry, oldest first
+	q.batchStarted()
+	q.batchStarted()
+	q.batchDone(true)
+	q.batchDone(true)
+	assert.True(t, signaled(first))
+	assert.True(t, signaled(second))
+	assert.Equal(t, 0, q.inFlight)
+
+	q.release(first)
+	assert.Equal(t, []*heldBatch{second}, q.held)
+}
+
+func TestTokenLimitErrors(t *testing.T) {
+	assert.True(t, isTokenLimitError(&httpStatusError{Status: 400, Body: []byte(`{"error":{"code":"token_limit_exceeded","message":"Enqueued token limit reached"}}`)}))
+	assert.False(t, isTokenLimitError(&httpStatusError{Status: 400, Body: []byte(`{"error":{"code":"invalid_request"}}`)}))
+	assert.False(t, isTokenLimitError(nil))
+
+	assert.True(t, tokenLimitExceeded(&BatchResponse{Errors: &BatchErrors{Data: []OpenAiError{{Code: errCodeTokenLimitExceeded}}}}))
+	assert.False(t, tokenLimitExceeded(&BatchResponse{Errors: &BatchErrors{Data: []OpenAiError{{Code: "invalid_request"}}}}))
+}
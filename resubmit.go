@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests left without a result by an expired batch (OpenAI couldn't run them
+// within the 24h window) get their partial output delivered as usual; the rest
+// are handled according to -expired-policy:
+//   resubmit  queued again in a fresh batch, up to -max-expirations times per request
+//   sync      sent through the synchronous (full price) API
+//   fail      answered with a batch_expired error
+//
+// Single lines failing with a transient status code (429, 5xx) are enqueued
+// again for the next batch, up to -max-request-attempts batches per request.
+
+const (
+	expiredResubmit = "resubmit"
+	expiredSync     = "sync"
+	expiredFail     = "fail"
+)
+
+var (
+	expiredPolicy   = expiredResubmit
+	maxExpirations  = 2      // batches a request may expire in before it's answered with an error
+	requestAttempts sync.Map // key: customID, value: *attempts
+
+	maxRequestAttempts = 3
+	retryStatusCodes   = map[int]bool{429: true, 500: true, 502: true, 503: true, 504: true}
+)
+
+// attempts tracks what happened to a request across the batches it was sent in
+type attempts struct {
+	expired     atomic.Int32 // batches that expired before running it
+	failed      atomic.Int32 // batch lines that failed with a retryable status code
+	replays     atomic.Int32 // times it was replayed from the dead-letter queue
+	resubmitted atomic.Int32 // times it was sent again in a new batch
+	splits      atomic.Int32 // times its batch was split in halves for failing validation
+}
+
+func attemptsOf(customID string) *attempts {
+	value, _ := requestAttempts.LoadOrStore(customID, &attempts{})
+	return value.(*attempts)
+}
+
+// forgetAttempts is called once the request has its response
+func forgetAttempts(customID string) {
+	requestAttempts.Delete(customID)
+}
+
+// handleExpiredRequests applies the expired policy to the requests of an expired
+// batch without a result. Requests it takes care of are removed from outstandingCustomIDs;
+// the others are left for the caller to answer with the batch error.
+func handleExpiredRequests(batchID string, key batchKey, customIDs []string, outstandingCustomIDs map[string]bool) {
+	if expiredPolicy == expiredFail {
+		return
+	}
+
+	var resubmit []ProxyRequest
+	sendSync := make(map[string]bool)
+	for _, customID := range customIDs {
+		if !outstandingCustomIDs[customID] {
+			continue
+		}
+		expired := attemptsOf(customID).expired.Add(1)
+
+		switch {
+		case expiredPolicy == expiredSync:
+			sendSync[customID] = true
+		case int(expired) < maxExpirations:
+			if value, ok := pendingRequests.Load(customID); ok {
+				resubmit = append(resubmit, value.(ProxyRequest))
+				delete(outstandingCustomIDs, customID)
+			}
+		default:
+			log.WithFields(log.Fields{
+				"requestID": customID,
+				"expired":   expired,
+			}).Warn("Request expired too many times, giving up")
+		}
+	}
+
+	if len(resubmit) > 0 {
+		log.WithFields(log.Fields{
+			"batchID":  batchID,
+			"requests": len(resubmit),
+		}).Info("Resubmitting the unfinished requests of an expired batch")
+		resubmitRequests(key, resubmit)
+	}
+
+	if len(sendSync) > 0 {
+		log.WithFields(log.Fields{
+			"batchID":  batchID,
+			"requests": len(sendSync),
+		}).Info("Sending the unfinished requests of an expired batch through the synchronous API")
+		sent := make([]string, 0, len(sendSync))
+		for customID := range sendSync {
+			sent = append(sent, customID)
+		}
+		sendAllSynchronously(sendSync, key) // leaves those it couldn't send in the map
+		for _, customID := range sent {
+			if !sendSync[customID] {
+				delete(outstandingCustomIDs, customID)
+			}
+		}
+	}
+}
+
+// retryFailedLine enqueues again a request whose batch line failed with a retryable
+// status code, unless it's out of attempts. Returns whether it was retried.
+func retryFailedLine(customID string, key batchKey, response proxyResponse) bool {
+	if !retryStatusCodes[response.StatusCode] {
+		return false
+	}
+	value, ok := pendingRequests.Load(customID)
+	if !ok {
+		return false // withdrawn
+	}
+	a := attemptsOf(customID)
+	failed := a.failed.Add(1)
+	if int(failed) >= maxRequestAttempts {
+		log.WithFields(log.Fields{
+			"requestID": customID,
+			"attempts":  failed,
+		}).Warn("Request out of attempts, returning its error")
+		return false
+	}
+
+	req := value.(ProxyRequest)
+	log.WithFields(log.Fields{
+		"requestID":  customID,
+		"statusCode": response.StatusCode,
+		"attempt":    failed,
+	}).Infof("Retrying request in the next batch: %s", response.errorMessage())
+	a.resubmitted.Add(1)
+	trackResubmitted(1)
+	batchJournal.requestRequeued(customID)
+	enqueueRequest(key, req)
+	return true
+}
+
+// parseStatusCodes parses a comma-separated list of HTTP status codes
+func parseStatusCodes(s string) (map[int]bool, error) {
+	codes := make(map[int]bool)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		code, err := strconv.Atoi(field)
+		if err != nil || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status code %q", field)
+		}
+		codes[code] = true
+	}
+	return codes, nil
+}
+
+// resubmitRequests sends requests again, in a new batch
+func resubmitRequests(key batchKey, batch []ProxyRequest) {
+	for _, req := range batch {
+		attemptsOf(req.CustomID).resubmitted.Add(1)
+		batchJournal.requestRequeued(req.CustomID)
+	}
+	trackResubmitted(len(batch))
+	submitBatch(marshalBatch(key, batch), key, batch)
+}
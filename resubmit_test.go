@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryFailedLine(t *testing.T) {
+	maxRequestAttempts = 2
+	req := ProxyRequest{CustomID: "req_retry", Method: "POST", Endpoint: "/v1/chat/completions"}
+	pendingRequests.Store(req.CustomID, req)
+	defer pendingRequests.Delete(req.CustomID)
+	defer forgetAttempts(req.CustomID)
+	key := batchKey{credentials: credentials{auth: "Bearer x"}, endpoint: req.Endpoint}
+
+	assert.False(t, retryFailedLine(req.CustomID, key, errorResponse(400, "invalid_request", "Bad request")))
+	assert.True(t, retryFailedLine(req.CustomID, key, errorResponse(429, "rate_limit_exceeded", "Slow down")))
+	assert.False(t, retryFailedLine(req.CustomID, key, errorResponse(500, "server_error", "Oops")), "out of attempts")
+
+	codes, err := parseStatusCodes("429, 503")
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]bool{429: true, 503: true}, codes)
+	_, err = parseStatusCodes("429,abc")
+	assert.Error(t, err)
+}
@@ -16,12 +16,18 @@ var (
 	batchesSuccessful       atomic.Int64
 	batchesFailed           atomic.Int64
 	synthesizedErrResponses atomic.Int64
+	syncFallbacks           atomic.Int64
+	requestsAbandoned       atomic.Int64
+	requestsResubmitted     atomic.Int64
+	callbacksDelivered      atomic.Int64
+	callbacksFailed         atomic.Int64
 
 	requestTimings     []float64
 	requestTimingsLock sync.Mutex
 
-	batchTimings     []float64
-	batchTimingsLock sync.Mutex
+	batchTimings          []float64
+	completedBatchTimings []float64 // only of the batches that completed, for the expected batch turnaround
+	batchTimingsLock      sync.Mutex
 )
 
 type Stats struct {
@@ -30,6 +36,9 @@ type Stats struct {
 		Successful              int64   `json:"successful"`
 		Failed                  int64   `json:"failed"`
 		SynthesizedErrResponses int64   `json:"synthesized_error_responses"`
+		SyncFallbacks           int64   `json:"sync_fallbacks"`
+		Abandoned               int64   `json:"abandoned"`
+		Resubmitted             int64   `json:"resubmitted"`
 		AvgTime                 float64 `json:"avg_time_ms"`
 		P50Time                 float64 `json:"p50_time_ms"`
 		P95Time                 float64 `json:"p95_time_ms"`
@@ -44,6 +53,14 @@ type Stats struct {
 		P95Time    float64 `json:"p95_time_ms"`
 		P99Time    float64 `json:"p99_time_ms"`
 	} `json:"batches"`
+	Callbacks struct {
+		Delivered int64 `json:"delivered"`
+		Failed    int64 `json:"failed"`
+	} `json:"callbacks"`
+	HeldBatches []heldBatchStatus `json:"held_batches"`
+	DeadLetters int               `json:"dead_letters"`
+	Breakers    []breakerStatus   `json:"breakers"`
+	Partitions  []partitionStatus `json:"partitions"`
 }
 
 func trackRequestStart() {
@@ -78,10 +95,52 @@ func trackBatchEnd(success bool, duration time.Duration) {
 	batchTimingsLock.Unlock()
 }
 
+// trackBatchCompleted records the turnaround of a batch that ran to completion.
+// Batches that failed early (upload, creation, validation) say nothing about how
+// long a batch takes.
+func trackBatchCompleted(duration time.Duration) {
+	batchTimingsLock.Lock()
+	completedBatchTimings = append(completedBatchTimings, float64(duration.Milliseconds()))
+	batchTimingsLock.Unlock()
+}
+
 func trackSynthesizedErrorResponse() {
 	synthesizedErrResponses.Add(1)
 }
 
+func trackSyncFallback() {
+	syncFallbacks.Add(1)
+}
+
+// trackRequestAbandoned counts requests whose clients disconnected before the response was ready
+func trackRequestAbandoned() {
+	requestsAbandoned.Add(1)
+}
+
+// trackResubmitted counts requests sent again in a new batch
+func trackResubmitted(requests int) {
+	requestsResubmitted.Add(int64(requests))
+}
+
+func trackCallback(delivered bool) {
+	if delivered {
+		callbacksDelivered.Add(1)
+	} else {
+		callbacksFailed.Add(1)
+	}
+}
+
+// medianBatchTime is the median duration of the batches completed so far, 0 if there are none
+func medianBatchTime() time.Duration {
+	batchTimingsLock.Lock()
+	defer batchTimingsLock.Unlock()
+	if len(completedBatchTimings) == 0 {
+		return 0
+	}
+	median, _ := stats.Median(completedBatchTimings)
+	return time.Duration(median) * time.Millisecond
+}
+
 func getStats() Stats {
 	var s Stats
 
@@ -89,11 +148,21 @@ func getStats() Stats {
 	s.Requests.Successful = requestsSuccessful.Load()
 	s.Requests.Failed = requestsFailed.Load()
 	s.Requests.SynthesizedErrResponses = synthesizedErrResponses.Load()
+	s.Requests.SyncFallbacks = syncFallbacks.Load()
+	s.Requests.Abandoned = requestsAbandoned.Load()
+	s.Requests.Resubmitted = requestsResubmitted.Load()
 
 	s.Batches.Total = batchesTotal.Load()
 	s.Batches.Successful = batchesSuccessful.Load()
 	s.Batches.Failed = batchesFailed.Load()
 
+	s.Callbacks.Delivered = callbacksDelivered.Load()
+	s.Callbacks.Failed = callbacksFailed.Load()
+	s.HeldBatches = heldBatches()
+	s.DeadLetters = deadLetters.size()
+	s.Breakers = breakerStatuses()
+	s.Partitions = partitionStatuses()
+
 	requestTimingsLock.Lock()
 	if len(requestTimings) > 0 {
 		s.Requests.AvgTime, _ = stats.Mean(requestTimings)
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The batch API doesn't support streaming. Requests with "stream": true are
+// batched without it, and the response is replayed to the client as the
+// server-sent event stream its endpoint would have sent (chat.completion.chunk
+// objects, text_completion chunks, or response.* events).
+
+// streamEvent is an event of an emulated stream. A string data is written as-is.
+type streamEvent struct {
+	name string // SSE event type, empty for unnamed events
+	data interface{}
+}
+
+// stripStreamOptions removes "stream" and "stream_options" from the request body,
+// returning whether the client asked for a stream and for usage in it
+func stripStreamOptions(body map[string]interface{}) (stream, includeUsage bool) {
+	stream, _ = body["stream"].(bool)
+	if options, ok := body["stream_options"].(map[string]interface{}); ok {
+		includeUsage, _ = options["include_usage"].(bool)
+	}
+	delete(body, "stream")
+	delete(body, "stream_options")
+	return stream, stream && includeUsage
+}
+
+// completionToChunks splits a chat.completion into the chunks OpenAI would have streamed:
+// for every choice, one with the role, one with the content and one with the finish reason.
+// With includeUsage, every chunk has "usage": null and a last chunk with no choices carries it.
+func completionToChunks(completion map[string]interface{}, includeUsage bool) []map[string]interface{} {
+	newChunk := func(choices []interface{}) map[string]interface{} {
+		chunk := map[string]interface{}{
+			"id":      completion["id"],
+			"object":  "chat.completion.chunk",
+			"created": completion["created"],
+			"model":   completion["model"],
+			"choices": choices,
+		}
+		if fingerprint, ok := completion["system_fingerprint"]; ok {
+			chunk["system_fingerprint"] = fingerprint
+		}
+		if tier, ok := completion["service_tier"]; ok {
+			chunk["service_tier"] = tier
+		}
+		if includeUsage {
+			chunk["usage"] = nil
+		}
+		return chunk
+	}
+	newChoice := func(index interface{}, delta map[string]interface{}, logprobs, finishReason interface{}) []interface{} {
+		return []interface{}{map[string]interface{}{
+			"index":         index,
+			"delta":         delta,
+			"logprobs":      logprobs,
+			"finish_reason": finishReason,
+		}}
+	}
+
+	var chunks []map[string]interface{}
+	choices, _ := completion["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		message, _ := choice["message"].(map[string]interface{})
+		role := message["role"]
+		if role == nil {
+			role = "assistant"
+		}
+
+		chunks = append(chunks, newChunk(newChoice(choice["index"], map[string]interface{}{"role": role, "content": ""}, nil, nil)))
+
+		delta := make(map[string]interface{})
+		if content, ok := message["content"].(string); ok && content != "" {
+			delta["content"] = content
+		}
+		if refusal, ok := message["refusal"].(string); ok && refusal != "" {
+			delta["refusal"] = refusal
+		}
+		if toolCalls, ok := message["tool_calls"].([]interface{}); ok && len(toolCalls) > 0 {
+			indexed := make([]interface{}, 0, len(toolCalls))
+			for i, tc := range toolCalls {
+				toolCall, ok := tc.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				withIndex := map[string]interface{}{"index": i}
+				for k, v := range toolCall {
+					withIndex[k] = v
+				}
+				indexed = append(indexed, withIndex)
+			}
+			delta["tool_calls"] = indexed
+		}
+		if len(delta) > 0 {
+			chunks = append(chunks, newChunk(newChoice(choice["index"], delta, choice["logprobs"], nil)))
+		}
+
+		chunks = append(chunks, newChunk(newChoice(choice["index"], map[string]interface{}{}, nil, choice["finish_reason"])))
+	}
+
+	if includeUsage {
+		chunk := newChunk([]interface{}{})
+		chunk["usage"] = completion["usage"]
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// chatCompletionEvents is the stream of a chat.completion: its chunks, then [DONE]
+func chatCompletionEvents(completion map[string]interface{}, includeUsage bool) []streamEvent {
+	var events []streamEvent
+	for _, chunk := range completionToChunks(completion, includeUsage) {
+		events = append(events, streamEvent{data: chunk})
+	}
+	return append(events, streamEvent{data: "[DONE]"})
+}
+
+// textCompletionEvents is the stream of a (legacy) text_completion: for every choice,
+// one chunk with the text and one with the finish reason, then usage if asked for, then [DONE]
+func textCompletionEvents(completion map[string]interface{}, includeUsage bool) []streamEvent {
+	newChunk := func(choices []interface{}) map[string]interface{} {
+		chunk := map[string]interface{}{
+			"id":      completion["id"],
+			"object":  "text_completion",
+			"created": completion["created"],
+			"model":   completion["model"],
+			"choices": choices,
+		}
+		if fingerprint, ok := completion["system_fingerprint"]; ok {
+			chunk["system_fingerprint"] = fingerprint
+		}
+		if includeUsage {
+			chunk["usage"] = nil
+		}
+		return chunk
+	}
+
+	var events []streamEvent
+	choices, _ := completion["choices"].([]interface{})
+	for _, c := range choices {
+		choice, ok := c.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		events = append(events, streamEvent{data: newChunk([]interface{}{map[string]interface{}{
+			"index":         choice["index"],
+			"text":          choice["text"],
+			"logprobs":      choice["logprobs"],
+			"finish_reason": nil,
+		}})})
+		events = append(events, streamEvent{data: newChunk([]interface{}{map[string]interface{}{
+			"index":         choice["index"],
+			"text":          "",
+			"logprobs":      nil,
+			"finish_reason": choice["finish_reason"],
+		}})})
+	}
+
+	if includeUsage {
+		chunk := newChunk([]interface{}{})
+		chunk["usage"] = completion["usage"]
+		events = append(events, streamEvent{data: chunk})
+	}
+	return append(events, streamEvent{data: "[DONE]"})
+}
+
+// stripResponseStream removes "stream" and "stream_options" from a Responses API request.
+// Usage is always part of the response.completed event.
+func stripResponseStream(body map[string]interface{}) (stream, includeUsage bool) {
+	stream, _ = body["stream"].(bool)
+	delete(body, "stream")
+	delete(body, "stream_options")
+	return stream, false
+}
+
+// responseEvents is the stream of a Responses API response: response.created, the
+// output items with their text as a single delta, and response.completed (or incomplete, failed)
+func responseEvents(response map[string]interface{}, _ bool) []streamEvent {
+	var events []streamEvent
+	add := func(eventType string, fields map[string]interface{}) {
+		fields["type"] = eventType
+		fields["sequence_number"] = len(events)
+		events = append(events, streamEvent{name: eventType, data: fields})
+	}
+
+	created := make(map[string]interface{}, len(response))
+	for k, v := range response {
+		created[k] = v
+	}
+	created["status"] = "in_progress"
+	created["output"] = []interface{}{}
+	created["usage"] = nil
+	add("response.created", map[string]interface{}{"response": created})
+
+	output, _ := response["output"].([]interface{})
+	for i, o := range output {
+		item, ok := o.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, _ := item["content"].([]interface{})
+		if item["type"] != "message" {
+			add("response.output_item.added", map[string]interface{}{"output_index": i, "item": item})
+			add("response.output_item.done", map[string]interface{}{"output_index": i, "item": item})
+			continue
+		}
+
+		added := make(map[string]interface{}, len(item))
+		for k, v := range item {
+			added[k] = v
+		}
+		added["status"] = "in_progress"
+		added["content"] = []interface{}{}
+		add("response.output_item.added", map[string]interface{}{"output_index": i, "item": added})
+
+		for j, p := range content {
+			part, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			position := func(fields map[string]interface{}) map[string]interface{} {
+				fields["item_id"] = item["id"]
+				fields["output_index"] = i
+				fields["content_index"] = j
+				return fields
+			}
+			text, isText := part["text"].(string)
+			if part["type"] != "output_text" || !isText {
+				add("response.content_part.added", position(map[string]interface{}{"part": part}))
+				add("response.content_part.done", position(map[string]interface{}{"part": part}))
+				continue
+			}
+			empty := map[string]interface{}{"type": "output_text", "text": "", "annotations": []interface{}{}}
+			add("response.content_part.added", position(map[string]interface{}{"part": empty}))
+			add("response.output_text.delta", position(map[string]interface{}{"delta": text}))
+			add("response.output_text.done", position(map[string]interface{}{"text": text}))
+			add("response.content_part.done", position(map[string]interface{}{"part": part}))
+		}
+		add("response.output_item.done", map[string]interface{}{"output_index": i, "item": item})
+	}
+
+	final := "response.completed"
+	switch response["status"] {
+	case "incomplete", "failed":
+		final = "response." + response["status"].(string)
+	}
+	add(final, map[string]interface{}{"response": response})
+	return events
+}
+
+// writeEmulatedStream writes the response as a text/event-stream, as the endpoint would have.
+// An error response is sent as an "error" event, like OpenAI does mid-stream.
+func writeEmulatedStream(w http.ResponseWriter, e *endpoint, response proxyResponse, includeUsage, headersSent bool) {
+	if !headersSent {
+		writeStreamHeaders(w)
+	}
+
+	if response.isError() {
+		data, _ := json.Marshal(response.Body)
+		fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+		return
+	}
+
+	body, _ := response.Body.(map[string]interface{})
+	for _, event := range e.streamEvents(body, includeUsage) {
+		data, ok := event.data.(string)
+		if !ok {
+			raw, err := json.Marshal(event.data)
+			if err != nil {
+				log.Printf("[Stream] Failed to marshal event: %v", err)
+				continue
+			}
+			data = string(raw)
+		}
+		if event.name != "" {
+			fmt.Fprintf(w, "event: %s\n", event.name)
+		}
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func writeStreamHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripStreamOptions(t *testing.T) {
+	body := map[string]interface{}{
+		"model":          "gpt-4o-mini",
+		"stream":         true,
+		"stream_options": map[string]interface{}{"include_usage": true},
+	}
+	stream, includeUsage := stripStreamOptions(body)
+	assert.True(t, stream)
+	assert.True(t, includeUsage)
+	assert.Equal(t, map[string]interface{}{"model": "gpt-4o-mini"}, body)
+
+	stream, includeUsage = stripStreamOptions(map[string]interface{}{"model": "gpt-4o-mini"})
+	assert.False(t, stream)
+	assert.False(t, includeUsage)
+}
+
+func TestWriteEmulatedStream(t *testing.T) {
+	var completion interface{}
+	err := json.Unmarshal([]byte(`{
+		"id": "chatcmpl-123",
+		"object": "chat.completion",
+		"created": 1694268190,
+		"model": "gpt-4o-mini",
+		"choices": [{
+			"index": 0,
+			"message": {"role": "assistant", "content": "Hello!"},
+			"logprobs": null,
+			"finish_reason": "stop"
+		}],
+		"usage": {"prompt_tokens": 9, "completion_tokens": 2, "total_tokens": 11}
+	}`), &completion)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	writeEmulatedStream(w, endpointFor("/v1/chat/completions"), proxyResponse{StatusCode: 200, Body: completion}, true, false)
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+
+	events := strings.Split(strings.TrimSpace(w.Body.String()), "\n\n")
+	assert.Len(t, events, 5) // role, content, finish reason, usage, [DONE]
+	assert.Equal(t, "data: [DONE]", events[4])
+
+	var chunks []map[string]interface{}
+	for _, event := range events[:4] {
+		var chunk map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(event, "data: ")), &chunk))
+		assert.Equal(t, "chat.completion.chunk", chunk["object"])
+		assert.Equal(t, "chatcmpl-123", chunk["id"])
+		chunks = append(chunks, chunk)
+	}
+
+	delta := func(chunk map[string]interface{}) map[string]interface{} {
+		return chunk["choices"].([]interface{})[0].(map[string]interface{})["delta"].(map[string]interface{})
+	}
+	assert.Equal(t, "assistant", delta(chunks[0])["role"])
+	assert.Equal(t, "Hello!", delta(chunks[1])["content"])
+	assert.Equal(t, "stop", chunks[2]["choices"].([]interface{})[0].(map[string]interface{})["finish_reason"])
+	assert.Nil(t, chunks[2]["usage"])
+	assert.Empty(t, chunks[3]["choices"])
+	assert.Equal(t, float64(11), chunks[3]["usage"].(map[string]interface{})["total_tokens"])
+}
+
+func TestResponseEvents(t *testing.T) {
+	var response map[string]interface{}
+	err := json.Unmarshal([]byte(`{
+		"id": "resp_123",
+		"object": "response",
+		"status": "completed",
+		"model": "gpt-4o-mini",
+		"output": [{
+			"id": "msg_1",
+			"type": "message",
+			"role": "assistant",
+			"status": "completed",
+			"content": [{"type": "output_text", "text": "Hello!", "annotations": []}]
+		}],
+		"usage": {"input_tokens": 9, "output_tokens": 2, "total_tokens": 11}
+	}`), &response)
+	assert.NoError(t, err)
+
+	events := responseEvents(response, false)
+	var types []string
+	for i, event := range events {
+		data := event.data.(map[string]interface{})
+		assert.Equal(t, event.name, data["type"])
+		assert.Equal(t, i, data["sequence_number"])
+		types = append(types, event.name)
+	}
+	assert.Equal(t, []string{
+		"response.created",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.completed",
+	}, types)
+	assert.Equal(t, "in_progress", events[0].data.(map[string]interface{})["response"].(map[string]interface{})["status"])
+	assert.Equal(t, "Hello!", events[3].data.(map[string]interface{})["delta"])
+	assert.Equal(t, response, events[7].data.(map[string]interface{})["response"])
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSyncConcurrency limits the parallel requests sent to the synchronous API when falling back
+const maxSyncConcurrency = 16
+
+// sendSyncRequest sends a request to the regular (full price) API and returns its response.
+// It's not retried (it isn't idempotent), and has the deadline of an upstream call.
+func sendSyncRequest(creds credentials, endpoint string, body interface{}) (proxyResponse, error) {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return proxyResponse{}, fmt.Errorf("failed to marshal request body: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(upstreamCtx, upstreamDeadline)
+	defer cancel()
+	url := upstreamNamed(creds.upstream).url(endpoint, requestModel(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonBody))
+	if err != nil {
+		return proxyResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	creds.setHeaders(req.Header)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return proxyResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	// error responses from OpenAI are also JSON, relay them to the client as-is
+	var respBody interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&respBody); err != nil {
+		return proxyResponse{}, fmt.Errorf("failed to parse response (HTTP status %d): %v", resp.StatusCode, err)
+	}
+	return normalizeResponse(resp.StatusCode, respBody), nil
+}
+
+// fetchSynchronously returns the synchronous API response for a request, or an error response
+func fetchSynchronously(customID string, creds credentials, endpoint string, body interface{}) proxyResponse {
+	trackSyncFallback()
+	response, err := sendSyncRequest(creds, endpoint, body)
+	if err != nil {
+		log.WithField("requestID", customID).Errorf("Synchronous request failed: %v", err)
+		trackSynthesizedErrorResponse()
+		return errorResponse(http.StatusBadGateway, errCodeSyncFailed, fmt.Sprintf("Synchronous request failed: %v", err))
+	}
+	return response
+}
+
+// sendAllSynchronously answers the outstanding requests through the synchronous API
+func sendAllSynchronously(outstandingCustomIDs map[string]bool, key batchKey) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxSyncConcurrency)
+
+	for customID := range outstandingCustomIDs {
+		value, ok := pendingRequests.Load(customID)
+		if !ok {
+			continue // left for the caller to report as missing
+		}
+		req := value.(ProxyRequest)
+		delete(outstandingCustomIDs, customID)
+
+		wg.Add(1)
+		sem <- struct{}{}
+		safeGo(func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			trackSyncFallback()
+			response, err := sendSyncRequest(key.credentials, req.Endpoint, req.Body)
+			if err != nil {
+				log.WithField("requestID", req.CustomID).Errorf("Synchronous fallback failed: %v", err)
+				sendErrorResponse(req.CustomID, key, errorResponse(http.StatusBadGateway, errCodeSyncFailed, fmt.Sprintf("Synchronous fallback failed: %v", err)))
+				return
+			}
+			deliverResponse(req.CustomID, response)
+		})
+	}
+	wg.Wait()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Requests can be batched by any provider with OpenAI-compatible Files and
+// Batches APIs (Groq, Together, Fireworks, Mistral, a local fake...). Upstreams
+// are defined in the JSON file given with -upstreams:
+//
+//   [
+//     {"name": "groq", "base_url": "https://api.groq.com/openai/v1", "endpoints": ["/v1/chat/completions"], "models": ["llama-*"]},
+//     {"name": "openai", "base_url": "https://api.openai.com/v1"}
+//   ]
+//
+// A request goes to the upstream named in its X-Proxy-Upstream header, or else
+// to the first one with a models pattern matching its model (an upstream without
+// models takes any), or else to the built-in openai upstream. Requests to an
+// endpoint the upstream can't batch, and every other path, are relayed to it as-is.
+// Azure OpenAI upstreams (type azure) are described in azure.go.
+
+const upstreamHeader = "X-Proxy-Upstream"
+
+const (
+	authBearer = "bearer"  // Authorization: Bearer <key>
+	authAPIKey = "api-key" // api-key: <key>
+	authNone   = "none"
+)
+
+type upstream struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type,omitempty"`      // openai (default, for any compatible API) or azure
+	BaseURL   string   `json:"base_url"`            // of the API, with its version, e.g. https://api.openai.com/v1
+	Auth      string   `json:"auth,omitempty"`      // how the client's key is sent: bearer (default), api-key or none
+	Endpoints []string `json:"endpoints,omitempty"` // the endpoints it batches, all of them if empty
+	Models    []string `json:"models,omitempty"`    // patterns of the models routed to it, e.g. "llama-*"
+
+	// azure only
+	APIVersion      string            `json:"api_version,omitempty"`      // api-version query parameter
+	Deployments     map[string]string `json:"deployments,omitempty"`      // key: model, value: Global Batch deployment
+	SyncDeployments map[string]string `json:"sync_deployments,omitempty"` // key: model, value: deployment for synchronous calls
+}
+
+var (
+	defaultUpstream = &upstream{Name: "openai", Type: upstreamOpenAI, BaseURL: OpenAIBaseURL, Auth: authBearer}
+	upstreams       = []*upstream{defaultUpstream} // in routing order
+)
+
+// loadUpstreams reads the upstream definitions from a JSON file
+func loadUpstreams(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var defined []*upstream
+	if err := json.Unmarshal(data, &defined); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", file, err)
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range defined {
+		switch {
+		case u.Name == "":
+			return fmt.Errorf("upstream without a name")
+		case seen[u.Name]:
+			return fmt.Errorf("duplicate upstream %q", u.Name)
+		case !strings.HasPrefix(u.BaseURL, "http://") && !strings.HasPrefix(u.BaseURL, "https://"):
+			return fmt.Errorf("upstream %q: invalid base_url %q", u.Name, u.BaseURL)
+		}
+		seen[u.Name] = true
+		u.BaseURL = strings.TrimSuffix(u.BaseURL, "/")
+		switch u.Type {
+		case "":
+			u.Type = upstreamOpenAI
+		case upstreamOpenAI:
+		case upstreamAzure:
+			if u.Auth == "" {
+				u.Auth = authAPIKey
+			}
+			if u.APIVersion == "" {
+				u.APIVersion = defaultAzureAPIVersion
+			}
+			if len(u.Endpoints) == 0 {
+				u.Endpoints = azureEndpoints
+			}
+		default:
+			return fmt.Errorf("upstream %q: invalid type %q, must be %s or %s", u.Name, u.Type, upstreamOpenAI, upstreamAzure)
+		}
+		switch u.Auth {
+		case "":
+			u.Auth = authBearer
+		case authBearer, authAPIKey, authNone:
+		default:
+			return fmt.Errorf("upstream %q: invalid auth %q, must be %s, %s or %s", u.Name, u.Auth, authBearer, authAPIKey, authNone)
+		}
+		for _, e := range u.Endpoints {
+			if endpointFor(e) == nil {
+				return fmt.Errorf("upstream %q: %s isn't a batch endpoint", u.Name, e)
+			}
+		}
+		for _, pattern := range u.Models {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("upstream %q: invalid models pattern %q", u.Name, pattern)
+			}
+		}
+	}
+
+	if !seen[defaultUpstream.Name] {
+		defined = append(defined, defaultUpstream)
+	}
+	upstreams = defined
+	for _, u := range upstreams {
+		log.WithFields(log.Fields{
+			"baseURL": u.BaseURL,
+			"models":  u.Models,
+		}).Infof("Upstream %s", u.Name)
+	}
+	return nil
+}
+
+// upstreamNamed returns the upstream with that name. Batches journaled before
+// upstreams existed (or whose upstream was removed) go to the built-in one.
+func upstreamNamed(name string) *upstream {
+	for _, u := range upstreams {
+		if u.Name == name {
+			return u
+		}
+	}
+	if name != "" {
+		log.Warnf("Unknown upstream %q, using %s", name, defaultUpstream.Name)
+	}
+	return defaultUpstream
+}
+
+// routeUpstream picks the upstream of a request from its X-Proxy-Upstream header and model
+func routeUpstream(header http.Header, model string) (*upstream, error) {
+	if name := header.Get(upstreamHeader); name != "" {
+		for _, u := range upstreams {
+			if u.Name == name {
+				return u, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown upstream %q", name)
+	}
+	for _, u := range upstreams {
+		if len(u.Models) == 0 {
+			return u, nil
+		}
+		for _, pattern := range u.Models {
+			if ok, _ := path.Match(pattern, model); ok {
+				return u, nil
+			}
+		}
+	}
+	return defaultUpstream, nil
+}
+
+// batches tells whether the upstream batches the endpoint
+func (u *upstream) batches(endpoint string) bool {
+	return endpointFor(endpoint) != nil && (len(u.Endpoints) == 0 || slices.Contains(u.Endpoints, endpoint))
+}
+
+// url returns the URL of a path of the API (e.g. /v1/chat/completions) at the upstream,
+// for a synchronous call. model is that of the request, if known.
+func (u *upstream) url(apiPath, model string) string {
+	if u.Type == upstreamAzure {
+		return u.azureSyncURL(apiPath, model)
+	}
+	return strings.TrimSuffix(u.BaseURL, "/v1") + apiPath
+}
+
+// apiURL returns the URL of a path of the Files/Batches API (e.g. /files) at the upstream
+func (u *upstream) apiURL(apiPath string) string {
+	if u.Type == upstreamAzure {
+		return u.azureURL(apiPath)
+	}
+	return u.BaseURL + apiPath
+}
+
+// batchEndpoint is how the upstream names an endpoint in batches and their lines
+func (u *upstream) batchEndpoint(endpoint string) string {
+	if u.Type == upstreamAzure {
+		return strings.TrimPrefix(endpoint, "/v1")
+	}
+	return endpoint
+}
+
+// batchLine adapts a request for the batch input file of the upstream
+func (u *upstream) batchLine(req ProxyRequest) ProxyRequest {
+	if u.Type == upstreamAzure {
+		return u.azureBatchLine(req)
+	}
+	return req
+}
+
+// setAuth sends the client's key the way the upstream expects it
+func (u *upstream) setAuth(header http.Header, auth string) {
+	switch {
+	case auth == "" || u.Auth == authNone:
+	case u.Auth == authAPIKey:
+		header.Set("api-key", strings.TrimPrefix(auth, "Bearer "))
+	default:
+		header.Set("Authorization", auth)
+	}
+}
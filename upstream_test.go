@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpstreams(t *testing.T) {
+	var received http.Header
+	fake := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/openai/v1/models", r.URL.Path)
+		received = r.Header
+		w.Write([]byte(`{"object":"list","data":[]}`))
+	}))
+	defer fake.Close()
+
+	path := filepath.Join(t.TempDir(), "upstreams.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "fake", "base_url": "`+fake.URL+`/openai/v1/", "auth": "api-key", "endpoints": ["/v1/chat/completions"], "models": ["llama-*"]}
+	]`), 0600))
+	assert.NoError(t, loadUpstreams(path))
+	defer func() { upstreams = []*upstream{defaultUpstream} }()
+
+	up, err := routeUpstream(http.Header{}, "llama-3.1-8b-instant")
+	assert.NoError(t, err)
+	assert.Equal(t, "fake", up.Name)
+	assert.True(t, up.batches("/v1/chat/completions"))
+	assert.False(t, up.batches("/v1/embeddings"))
+	assert.Equal(t, fake.URL+"/openai/v1/chat/completions", up.url("/v1/chat/completions", "llama-3.1-8b-instant"))
+
+	up, err = routeUpstream(http.Header{}, "gpt-4o-mini")
+	assert.NoError(t, err)
+	assert.Equal(t, defaultUpstream, up)
+	_, err = routeUpstream(http.Header{upstreamHeader: {"nope"}}, "gpt-4o-mini")
+	assert.Error(t, err)
+
+	// pass-through goes to the upstream of the header, with its auth style
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer sk-x")
+	req.Header.Set(upstreamHeader, "fake")
+	req.Header.Set(maxWaitHeader, "2m")
+	req.Header.Set(adminTokenHeader, "s3cret")
+	req.Header.Set(idempotencyKeyHeader, "key-1")
+	req.Header.Set("OpenAI-Beta", "assistants=v2")
+	w := httptest.NewRecorder()
+	handleNoopOpenaiProxy(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "sk-x", received.Get("api-key"))
+	assert.Empty(t, received.Get("Authorization"))
+	// the headers meant for the proxy aren't relayed, the others are
+	assert.Empty(t, received.Get(upstreamHeader))
+	assert.Empty(t, received.Get(maxWaitHeader))
+	assert.Empty(t, received.Get(adminTokenHeader))
+	assert.Empty(t, received.Get(idempotencyKeyHeader))
+	assert.Equal(t, "assistants=v2", received.Get("OpenAI-Beta"))
+
+	for _, invalid := range []string{
+		`[{"base_url": "https://example.com/v1"}]`,
+		`[{"name": "x", "base_url": "example.com"}]`,
+		`[{"name": "x", "base_url": "https://example.com/v1", "auth": "basic"}]`,
+		`[{"name": "x", "base_url": "https://example.com/v1", "endpoints": ["/v1/images/generations"]}]`,
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0600))
+		assert.Error(t, loadUpstreams(path), invalid)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// OpenAI validates the whole input file before running a batch, and a single
+// invalid request (e.g. an unknown model) fails the batch for everyone. The
+// validation errors usually carry the (1-based) line of the offending request.
+
+// maxValidationSplits bounds the halving of batches failing validation without line
+// numbers: a systemic failure (or every line being invalid) would otherwise turn a
+// batch of N requests into 2N-1 batches, a poll latency apart.
+var maxValidationSplits = 4
+
+// isolateInvalidRequests answers the requests on the lines reported by the failed
+// validation with their own error, and resubmits the rest as a new batch. Without
+// line numbers, the batch is split in halves until the invalid requests are alone,
+// up to maxValidationSplits times. Requests it takes care of are removed from outstandingCustomIDs.
+func isolateInvalidRequests(batch *BatchResponse, key batchKey, customIDs []string, outstandingCustomIDs map[string]bool) {
+	invalid := invalidRequests(batch, customIDs, outstandingCustomIDs)
+	if len(invalid) == 0 && len(outstandingCustomIDs) == 1 {
+		return // that's the invalid one: it gets the batch error
+	}
+	if len(invalid) == 0 && splitDepth(outstandingCustomIDs) >= maxValidationSplits {
+		log.WithFields(log.Fields{
+			"batchID":  batch.ID,
+			"requests": len(outstandingCustomIDs),
+		}).Warn("Batch still fails validation after splitting it, giving up on its requests")
+		return // they get the batch error
+	}
+
+	var valid []ProxyRequest
+	for _, customID := range customIDs {
+		if !outstandingCustomIDs[customID] {
+			continue
+		}
+		if e, ok := invalid[customID]; ok {
+			log.WithField("requestID", customID).Infof("Request failed batch validation: %s", e.Message)
+			deliverResponse(customID, validationErrorResponse(e))
+			delete(outstandingCustomIDs, customID)
+			continue
+		}
+		value, ok := pendingRequests.Load(customID)
+		if !ok {
+			continue // withdrawn
+		}
+		valid = append(valid, value.(ProxyRequest))
+		delete(outstandingCustomIDs, customID)
+	}
+	if len(valid) == 0 {
+		return
+	}
+
+	if len(invalid) > 0 {
+		log.WithFields(log.Fields{
+			"batchID":  batch.ID,
+			"invalid":  len(invalid),
+			"requests": len(valid),
+		}).Info("Resubmitting the valid requests of a batch that failed validation")
+		resubmitRequests(key, valid)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"batchID":  batch.ID,
+		"requests": len(valid),
+	}).Info("Batch failed validation without line numbers, splitting it in halves")
+	for _, req := range valid {
+		attemptsOf(req.CustomID).splits.Add(1)
+	}
+	half := len(valid) / 2
+	resubmitRequests(key, valid[:half])
+	resubmitRequests(key, valid[half:])
+}
+
+// splitDepth is how many times the batch of the requests was split in halves
+func splitDepth(customIDs map[string]bool) int {
+	depth := 0
+	for customID := range customIDs {
+		depth = max(depth, int(attemptsOf(customID).splits.Load()))
+	}
+	return depth
+}
+
+// invalidRequests maps the validation errors with a line number to the outstanding request on that line
+func invalidRequests(batch *BatchResponse, customIDs []string, outstandingCustomIDs map[string]bool) map[string]*OpenAiError {
+	invalid := make(map[string]*OpenAiError)
+	if batch.Errors == nil {
+		return invalid
+	}
+	for i := range batch.Errors.Data {
+		e := &batch.Errors.Data[i]
+		if e.Line == nil || *e.Line < 1 || *e.Line > len(customIDs) {
+			continue
+		}
+		if customID := customIDs[*e.Line-1]; outstandingCustomIDs[customID] {
+			invalid[customID] = e
+		}
+	}
+	return invalid
+}
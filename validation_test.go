@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidRequests(t *testing.T) {
+	line := func(n int) *int { return &n }
+	batch := &BatchResponse{Errors: &BatchErrors{Data: []OpenAiError{
+		{Code: "model_not_found", Message: "The model does not exist", Line: line(2)},
+		{Code: "invalid_request", Message: "Out of range", Line: line(7)},
+		{Code: "invalid_request", Message: "No line"},
+	}}}
+	customIDs := []string{"req_1", "req_2", "req_3"}
+
+	invalid := invalidRequests(batch, customIDs, toSet(customIDs))
+	assert.Len(t, invalid, 1)
+	assert.Equal(t, "model_not_found", invalid["req_2"].Code)
+
+	response := validationErrorResponse(invalid["req_2"])
+	assert.Equal(t, 400, response.StatusCode)
+	assert.Equal(t, "The model does not exist", response.errorMessage())
+
+	// already answered requests are not isolated again
+	assert.Empty(t, invalidRequests(batch, customIDs, toSet([]string{"req_1", "req_3"})))
+}
+
+func TestIsolateInvalidRequestsGivesUp(t *testing.T) {
+	customIDs := []string{"req_split_1", "req_split_2"}
+	for _, customID := range customIDs {
+		attemptsOf(customID).splits.Store(int32(maxValidationSplits))
+		defer forgetAttempts(customID)
+	}
+	batch := &BatchResponse{ID: "batch_1", Status: "failed", Errors: &BatchErrors{Data: []OpenAiError{{Code: "invalid_request", Message: "Invalid file"}}}}
+
+	// split too many times already: left for the caller to answer with the batch error
+	outstanding := toSet(customIDs)
+	isolateInvalidRequests(batch, batchKey{endpoint: "/v1/chat/completions"}, customIDs, outstanding)
+	assert.Equal(t, toSet(customIDs), outstanding)
+	assert.Equal(t, maxValidationSplits, splitDepth(outstanding))
+}